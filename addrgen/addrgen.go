@@ -21,6 +21,7 @@ type AddrGen interface {
 type PortGen interface {
 	Port() uint16
 	Power() uint16
+	Ports() []uint16
 }
 
 type EndpointGen interface {
@@ -38,6 +38,14 @@ func (p PortRange) Power() uint16 {
 	return p.portNum
 }
 
+func (p PortRange) Ports() []uint16 {
+	res := make([]uint16, p.portNum)
+	for i := range res {
+		res[i] = p.portBase + uint16(i)
+	}
+	return res
+}
+
 var _ PortGen = SinglePort(0)
 
 type SinglePort uint16
@@ -50,6 +58,10 @@ func (p SinglePort) Power() uint16 {
 	return 1
 }
 
+func (p SinglePort) Ports() []uint16 {
+	return []uint16{uint16(p)}
+}
+
 func ParsePortRangeSpec(spec string) (PortGen, error) {
 	parts := strings.SplitN(spec, "-", 2)
 	switch len(parts) {
@@ -46,3 +46,18 @@ func TestPortRange(t *testing.T) {
 		}
 	}
 }
+
+func TestPorts(t *testing.T) {
+	ports := must(ParsePortRangeSpec("20005-20000")).Ports()
+	if len(ports) != 6 {
+		t.Fatalf("unexpected number of ports: %d", len(ports))
+	}
+	for i, p := range ports {
+		if p != uint16(20000+i) {
+			t.Errorf("unexpected port at index %d: %d", i, p)
+		}
+	}
+	if ports := must(ParsePortRangeSpec("443")).Ports(); len(ports) != 1 || ports[0] != 443 {
+		t.Errorf("unexpected ports: %v", ports)
+	}
+}
@@ -0,0 +1,28 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/SenseUnit/dtlspipe/session"
+)
+
+// NewHandler returns HTTP handler of admin API:
+//
+//	GET /sessions - list active sessions
+//	DELETE /sessions/{id} - terminate session
+func NewHandler(registry *session.Registry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registry.List())
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !registry.Kill(r.PathValue("id")) {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SenseUnit/dtlspipe/session"
+)
+
+func TestHandler(t *testing.T) {
+	registry := session.NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := session.New("server", "127.0.0.1:1", "127.0.0.1:2", "alice", "127.0.0.1:3", cancel)
+	registry.Add(s)
+	srv := httptest.NewServer(NewHandler(registry))
+	defer srv.Close()
+
+	do := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/sessions")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status of session list: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type: %q", ct)
+	}
+	var list []session.Info
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("can't decode session list: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != s.ID() || list[0].Identity != "alice" {
+		t.Errorf("unexpected session list: %+v", list)
+	}
+
+	if resp := do(http.MethodDelete, "/sessions/nonexistent"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status of unknown session kill: %d", resp.StatusCode)
+	}
+	if ctx.Err() != nil {
+		t.Error("session is killed by request for another session")
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPost, "/sessions"},
+		{http.MethodDelete, "/sessions"},
+		{http.MethodGet, "/sessions/" + s.ID()},
+	} {
+		if resp := do(req.method, req.path); resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: unexpected status %d", req.method, req.path, resp.StatusCode)
+		}
+	}
+
+	if resp := do(http.MethodDelete, "/sessions/"+s.ID()); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status of session kill: %d", resp.StatusCode)
+	}
+	if ctx.Err() == nil {
+		t.Error("session is not killed")
+	}
+}
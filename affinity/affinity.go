@@ -0,0 +1,71 @@
+// Package affinity implements session tokens which let server attach
+// reconnecting client session to the same upstream socket.
+package affinity
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Protocol is ALPN protocol name which identifies DTLS connections
+// carrying session token.
+const Protocol = "dtlspipe-affinity/1"
+
+// TokenSize is length of session token.
+const TokenSize = 16
+
+var ErrBadToken = errors.New("malformed session token")
+
+// TokenGenerator derives session tokens from local addresses of client
+// sessions, so sessions of the same local socket get the same token.
+type TokenGenerator struct {
+	key []byte
+}
+
+// NewTokenGenerator creates generator with random key. Tokens are
+// different for each generator.
+func NewTokenGenerator() (*TokenGenerator, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("can't generate token key: %w", err)
+	}
+	return &TokenGenerator{key: key}, nil
+}
+
+// Token returns token for session of local socket with address addr.
+func (g *TokenGenerator) Token(addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:TokenSize]
+}
+
+// WriteToken sends token as first datagram of conn.
+func WriteToken(conn net.Conn, token []byte) error {
+	if _, err := conn.Write(token); err != nil {
+		return fmt.Errorf("can't send session token: %w", err)
+	}
+	return nil
+}
+
+// ReadToken reads token sent by WriteToken, waiting for it at most
+// timeout.
+func ReadToken(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, TokenSize+1)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("can't receive session token: %w", err)
+	}
+	if n != TokenSize {
+		return nil, ErrBadToken
+	}
+	return buf[:n], nil
+}
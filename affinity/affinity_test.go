@@ -0,0 +1,45 @@
+package affinity
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	gen, err := NewTokenGenerator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr1 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	addr2 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001}
+	token := gen.Token(addr1)
+	if len(token) != TokenSize {
+		t.Fatalf("unexpected token size %d", len(token))
+	}
+	if !bytes.Equal(token, gen.Token(addr1)) {
+		t.Error("token is not stable")
+	}
+	if bytes.Equal(token, gen.Token(addr2)) {
+		t.Error("tokens of different addresses are equal")
+	}
+	other, _ := NewTokenGenerator()
+	if bytes.Equal(token, other.Token(addr1)) {
+		t.Error("tokens of different generators are equal")
+	}
+
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	go WriteToken(left, token)
+	received, err := ReadToken(right, time.Second)
+	if err != nil || !bytes.Equal(received, token) {
+		t.Fatalf("unexpected token %x: %v", received, err)
+	}
+	go left.Write([]byte("short"))
+	if _, err := ReadToken(right, time.Second); !errors.Is(err, ErrBadToken) {
+		t.Fatalf("expected bad token error, got %v", err)
+	}
+}
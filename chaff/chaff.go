@@ -0,0 +1,268 @@
+// Package chaff implements decoy traffic which hides timing of idle
+// periods of DTLS connection. Chaff datagrams are sent on randomized
+// schedule while connection is idle and discarded by receiving side.
+package chaff
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/randpool"
+	"github.com/pion/dtls/v3"
+)
+
+// Protocol is ALPN protocol name of connections with chaff without other
+// protocol features.
+const Protocol = "dtlspipe-chaff/1"
+
+const (
+	protocolSuffix = "+chaff"
+
+	minSize   = 32
+	maxSize   = 512
+	maxPktBuf = 65536
+)
+
+// Every datagram of connection with chaff starts with frame type.
+const (
+	frameData  = 0
+	frameChaff = 1
+)
+
+// ProtocolFor returns ALPN protocol name of variant of protocol with
+// chaff.
+func ProtocolFor(protocol string) string {
+	if protocol == "" {
+		return Protocol
+	}
+	return protocol + protocolSuffix
+}
+
+// SplitProtocol returns protocol without chaff and reports whether
+// protocol is variant with chaff.
+func SplitProtocol(protocol string) (string, bool) {
+	if protocol == Protocol {
+		return "", true
+	}
+	if base, ok := strings.CutSuffix(protocol, protocolSuffix); ok {
+		return base, true
+	}
+	return protocol, false
+}
+
+// Schedule chooses intervals between chaff datagrams.
+type Schedule interface {
+	Next() time.Duration
+}
+
+type poisson struct {
+	mean float64
+}
+
+func (s poisson) Next() time.Duration {
+	var d float64
+	randpool.Borrow(func(r *rand.Rand) {
+		d = r.ExpFloat64() * s.mean
+	})
+	return time.Duration(d)
+}
+
+type fixed time.Duration
+
+func (s fixed) Next() time.Duration {
+	return time.Duration(s)
+}
+
+// ParseSchedule parses schedule spec: "poisson:<rate>" for Poisson
+// process or "fixed:<rate>" for constant intervals. Rate is number of
+// datagrams per second.
+func ParseSchedule(spec string) (Schedule, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	rate, err := strconv.ParseFloat(arg, 64)
+	if err != nil || !(rate > 0) || rate > 1e6 {
+		return nil, fmt.Errorf("bad chaff rate %q", arg)
+	}
+	mean := float64(time.Second) / rate
+	switch kind {
+	case "poisson":
+		return poisson{mean: mean}, nil
+	case "fixed":
+		return fixed(mean), nil
+	}
+	return nil, fmt.Errorf("unknown chaff schedule %q", kind)
+}
+
+// DefaultBudget is default chaff bandwidth limit in bytes per second.
+const DefaultBudget = 4096
+
+// Budget limits bandwidth spent on chaff. It's shared by all connections
+// of tunnel.
+type Budget struct {
+	rate float64
+
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBudget creates budget allowing rate bytes per second with bursts of
+// up to one second worth of traffic.
+func NewBudget(rate int) *Budget {
+	return &Budget{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take reports whether n bytes fit into budget and spends them if so.
+func (b *Budget) take(n int) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Conn frames datagrams of connection with chaff. Each datagram carries
+// frame type byte, so chaff can't be confused with any payload. Received
+// chaff is discarded before Read returns and doesn't update activity
+// time, which decides whether connection is idle enough to send chaff.
+type Conn struct {
+	net.Conn
+	role     string
+	schedule Schedule
+	budget   *Budget
+
+	lastActivity atomic.Int64
+	readMux      sync.Mutex
+	readBuf      []byte
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewConn wraps conn. Role is used as label of metrics. Nil schedule
+// disables sending of chaff.
+func NewConn(conn net.Conn, role string, schedule Schedule, budget *Budget) *Conn {
+	c := &Conn{
+		Conn:     conn,
+		role:     role,
+		schedule: schedule,
+		budget:   budget,
+		readBuf:  make([]byte, maxPktBuf),
+		closed:   make(chan struct{}),
+	}
+	c.lastActivity.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMux.Lock()
+	defer c.readMux.Unlock()
+	for {
+		n, err := c.Conn.Read(c.readBuf)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		switch c.readBuf[0] {
+		case frameData:
+			c.lastActivity.Store(time.Now().UnixNano())
+			return copy(b, c.readBuf[1:n]), nil
+		case frameChaff:
+			metrics.ChaffDatagrams.With(c.role, "received").Inc()
+			metrics.ChaffBytes.With(c.role, "received").Add(uint64(n))
+		}
+		// frames of unknown type are skipped
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.lastActivity.Store(time.Now().UnixNano())
+	frame := make([]byte, 1+len(b))
+	frame[0] = frameData
+	copy(frame[1:], b)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// Run sends chaff until connection is closed. Chaff is sent only if
+// connection had no traffic since previous chaff was scheduled and there
+// is enough budget for it.
+func (c *Conn) Run() {
+	if c.schedule == nil {
+		return
+	}
+	sentDatagrams := metrics.ChaffDatagrams.With(c.role, "sent")
+	sentBytes := metrics.ChaffBytes.With(c.role, "sent")
+	for {
+		scheduled := time.Now()
+		timer := time.NewTimer(c.schedule.Next())
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return
+		}
+		if c.lastActivity.Load() > scheduled.UnixNano() {
+			continue
+		}
+		datagram := newDatagram()
+		if !c.budget.take(len(datagram)) {
+			continue
+		}
+		if _, err := c.Conn.Write(datagram); err != nil {
+			return
+		}
+		sentDatagrams.Inc()
+		sentBytes.Add(uint64(len(datagram)))
+	}
+}
+
+func newDatagram() []byte {
+	var size int
+	randpool.Borrow(func(r *rand.Rand) {
+		size = minSize + r.Intn(maxSize-minSize+1)
+	})
+	datagram := make([]byte, size)
+	datagram[0] = frameChaff
+	return datagram
+}
+
+// ConnectionState returns state of underlying DTLS connection with chaff
+// removed from negotiated protocol, so upper layers see protocol they
+// handle.
+func (c *Conn) ConnectionState() (dtls.State, bool) {
+	stater, ok := c.Conn.(interface {
+		ConnectionState() (dtls.State, bool)
+	})
+	if !ok {
+		return dtls.State{}, false
+	}
+	state, ok := stater.ConnectionState()
+	state.NegotiatedProtocol, _ = SplitProtocol(state.NegotiatedProtocol)
+	return state, ok
+}
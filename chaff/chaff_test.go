@@ -0,0 +1,99 @@
+package chaff
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule("fixed:4")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := s.Next(); d != 250*time.Millisecond {
+		t.Errorf("unexpected interval %v", d)
+	}
+	s, err = ParseSchedule("poisson:10")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var total time.Duration
+	for i := 0; i < 1000; i++ {
+		total += s.Next()
+	}
+	if mean := total / 1000; mean < 80*time.Millisecond || mean > 120*time.Millisecond {
+		t.Errorf("unexpected mean interval %v", mean)
+	}
+	for _, spec := range []string{"", "poisson", "poisson:0", "fixed:x", "gauss:1"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(1000)
+	if !b.take(600) {
+		t.Fatal("budget is not available")
+	}
+	if b.take(600) {
+		t.Fatal("budget is exceeded")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if !b.take(600) {
+		t.Fatal("budget is not replenished")
+	}
+}
+
+func TestConn(t *testing.T) {
+	left, right := net.Pipe()
+	schedule, _ := ParseSchedule("fixed:20")
+	sender := NewConn(left, "test", schedule, NewBudget(1000000))
+	receiver := NewConn(right, "test", nil, nil)
+	defer receiver.Close()
+	go sender.Run()
+
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			n, err := right.Read(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	select {
+	case b := <-received:
+		if b[0] != frameChaff || len(b) < minSize || len(b) > maxSize {
+			t.Fatalf("unexpected chaff datagram %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("chaff is not sent")
+	}
+	sender.Close()
+	for range received {
+	}
+
+	left, right = net.Pipe()
+	defer left.Close()
+	receiver = NewConn(right, "test", nil, nil)
+	defer receiver.Close()
+	sender = NewConn(left, "test", nil, nil)
+	go func() {
+		left.Write(newDatagram())
+		// payload which looks like chaff is delivered as is
+		sender.Write([]byte{frameChaff, 0, 0})
+		sender.Write([]byte("data"))
+	}()
+	buf := make([]byte, 1000)
+	if n, err := receiver.Read(buf); err != nil || string(buf[:n]) != "\x01\x00\x00" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+	if n, err := receiver.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+}
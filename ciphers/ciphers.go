@@ -2,6 +2,7 @@ package ciphers
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/pion/dtls/v3"
@@ -9,7 +10,8 @@ import (
 
 type CipherList = []dtls.CipherSuiteID
 
-var FullCipherList = CipherList{
+// PSKCipherList is a list of ciphers usable with pre-shared keys.
+var PSKCipherList = CipherList{
 	dtls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256,
 	dtls.TLS_PSK_WITH_AES_128_CCM,
 	dtls.TLS_PSK_WITH_AES_128_CCM_8,
@@ -18,7 +20,21 @@ var FullCipherList = CipherList{
 	dtls.TLS_PSK_WITH_AES_128_CBC_SHA256,
 }
 
-var DefaultCipherList = FullCipherList
+// CertCipherList is a list of forward-secret AEAD ciphers usable with
+// certificates.
+var CertCipherList = CipherList{
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+}
+
+var FullCipherList = slices.Concat(PSKCipherList, CertCipherList)
+
+var DefaultCipherList = PSKCipherList
+var DefaultCertCipherList = CertCipherList
 var DefaultCipherListString = CipherListToString(DefaultCipherList)
 var CipherNameToID map[string]dtls.CipherSuiteID
 
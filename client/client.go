@@ -2,13 +2,22 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/SenseUnit/dtlspipe/affinity"
+	"github.com/SenseUnit/dtlspipe/chaff"
+	"github.com/SenseUnit/dtlspipe/flowmux"
+	"github.com/SenseUnit/dtlspipe/hsprofile"
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/padding"
+	"github.com/SenseUnit/dtlspipe/session"
 	"github.com/SenseUnit/dtlspipe/util"
 	"github.com/pion/dtls/v3"
 	"github.com/pion/transport/v3/udp"
@@ -19,36 +28,148 @@ const (
 	Backlog   = 1024
 )
 
-type Client struct {
-	listener      net.Listener
+type settings struct {
 	dtlsConfig    *dtls.Config
-	remoteDialFn  func(context.Context) (net.PacketConn, net.Addr, error)
-	psk           func([]byte) ([]byte, error)
-	timeout       time.Duration
 	idleTimeout   time.Duration
-	baseCtx       context.Context
-	cancelCtx     func()
-	staleMode     util.StaleMode
-	workerWG      sync.WaitGroup
 	timeLimitFunc func() time.Duration
 	allowFunc     func(net.Addr) bool
 }
 
+func settingsFromConfig(cfg *Config) *settings {
+	dtlsConfig := &dtls.Config{
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		MTU:                  cfg.MTU,
+		CipherSuites:         cfg.CipherSuites,
+		EllipticCurves:       cfg.EllipticCurves,
+		SessionStore:         cfg.SessionStore,
+	}
+	if cfg.PSKCallback != nil {
+		dtlsConfig.PSK = cfg.PSKCallback
+		dtlsConfig.PSKIdentityHint = []byte(cfg.PSKIdentity)
+	} else {
+		// certificate mode. Server certificate is verified against
+		// RootCAs if they are specified or if there are no pins.
+		dtlsConfig.Certificates = cfg.Certificates
+		dtlsConfig.RootCAs = cfg.RootCAs
+		dtlsConfig.ServerName = cfg.ServerName
+		if len(cfg.PinnedSPKI) > 0 {
+			dtlsConfig.InsecureSkipVerify = cfg.RootCAs == nil
+			dtlsConfig.VerifyPeerCertificate = util.VerifySPKIPins(cfg.PinnedSPKI)
+		}
+	}
+	if cfg.HandshakeProfile != nil {
+		cfg.HandshakeProfile.Apply(dtlsConfig)
+	}
+	if cfg.EnableCID {
+		dtlsConfig.ConnectionIDGenerator = dtls.OnlySendCIDGenerator()
+	}
+	if cfg.Multiplex > 0 {
+		dtlsConfig.SupportedProtocols = []string{flowmux.Protocol}
+	}
+	if cfg.UpstreamAffinity {
+		dtlsConfig.SupportedProtocols = []string{affinity.Protocol}
+	}
+	if cfg.Keepalive > 0 || cfg.Chaff != nil || cfg.Padding != nil {
+		var protocol string
+		if len(dtlsConfig.SupportedProtocols) > 0 {
+			protocol = dtlsConfig.SupportedProtocols[0]
+		}
+		if cfg.Keepalive > 0 {
+			protocol = util.KeepaliveProtocolFor(protocol)
+		}
+		if cfg.Chaff != nil {
+			protocol = chaff.ProtocolFor(protocol)
+		}
+		if cfg.Padding != nil {
+			protocol = padding.ProtocolFor(protocol)
+		}
+		dtlsConfig.SupportedProtocols = []string{protocol}
+	}
+	return &settings{
+		dtlsConfig:    dtlsConfig,
+		idleTimeout:   cfg.IdleTimeout,
+		timeLimitFunc: cfg.TimeLimitFunc,
+		allowFunc:     cfg.AllowFunc,
+	}
+}
+
+type Client struct {
+	listener     net.Listener
+	remoteDialFn func(context.Context) (net.PacketConn, net.Addr, error)
+	timeout      time.Duration
+	rotationLead time.Duration
+	hopInterval  func() time.Duration
+	keepalive    time.Duration
+	padding      padding.Distribution
+	chaff        chaff.Schedule
+	chaffBudget  *chaff.Budget
+	profile      *hsprofile.Profile
+	knockPSK     bool
+	knockPorts   []uint16
+	tokens       *affinity.TokenGenerator
+	muxPool      *muxPool
+	warmPool     *warmPool
+	baseCtx      context.Context
+	cancelCtx    func()
+	sessions     *session.Registry
+	logger       *slog.Logger
+	pairStats    *util.PairStats
+	staleMode    util.StaleMode
+	workerWG     sync.WaitGroup
+	settings     atomic.Pointer[settings]
+}
+
 func New(cfg *Config) (*Client, error) {
 	cfg = cfg.populateDefaults()
 
+	if cfg.HopIntervalFunc != nil && !cfg.EnableCID {
+		return nil, errors.New("endpoint hopping requires connection_id extension to be enabled")
+	}
+	if cfg.Multiplex > 0 && cfg.RotationLeadTime > 0 {
+		return nil, errors.New("session rotation is not supported with multiplexing")
+	}
+	if cfg.Multiplex > 0 && cfg.WarmPoolSize > 0 {
+		return nil, errors.New("warm pool is not supported with multiplexing")
+	}
+	if cfg.Multiplex > 0 && cfg.UpstreamAffinity {
+		return nil, errors.New("upstream affinity is not supported with multiplexing")
+	}
+
 	baseCtx, cancelCtx := context.WithCancel(cfg.BaseContext)
 
 	client := &Client{
-		remoteDialFn:  cfg.RemoteDialFunc,
-		timeout:       cfg.Timeout,
-		psk:           cfg.PSKCallback,
-		idleTimeout:   cfg.IdleTimeout,
-		baseCtx:       baseCtx,
-		cancelCtx:     cancelCtx,
-		staleMode:     cfg.StaleMode,
-		timeLimitFunc: cfg.TimeLimitFunc,
-		allowFunc:     cfg.AllowFunc,
+		remoteDialFn: cfg.RemoteDialFunc,
+		timeout:      cfg.Timeout,
+		rotationLead: cfg.RotationLeadTime,
+		hopInterval:  cfg.HopIntervalFunc,
+		keepalive:    cfg.Keepalive,
+		padding:      cfg.Padding,
+		chaff:        cfg.Chaff,
+		chaffBudget:  chaff.NewBudget(cfg.ChaffBudget),
+		profile:      cfg.HandshakeProfile,
+		knockPSK:     cfg.Knock,
+		knockPorts:   cfg.KnockPorts,
+		baseCtx:      baseCtx,
+		cancelCtx:    cancelCtx,
+		staleMode:    cfg.StaleMode,
+		sessions:     cfg.Sessions,
+		logger:       cfg.Logger,
+		pairStats:    util.NewPairStats("client", cfg.StaleMode),
+	}
+	client.settings.Store(settingsFromConfig(cfg))
+	if cfg.UpstreamAffinity {
+		tokens, err := affinity.NewTokenGenerator()
+		if err != nil {
+			cancelCtx()
+			return nil, err
+		}
+		client.tokens = tokens
+	}
+	if cfg.Multiplex > 0 {
+		client.muxPool = newMuxPool(client, cfg.Multiplex)
+	}
+	if cfg.WarmPoolSize > 0 {
+		client.warmPool = newWarmPool(client, cfg.WarmPoolSize, cfg.WarmPoolTTL)
 	}
 
 	lAddrPort, err := netip.ParseAddrPort(cfg.BindAddress)
@@ -57,18 +178,6 @@ func New(cfg *Config) (*Client, error) {
 		return nil, fmt.Errorf("can't parse bind address: %w", err)
 	}
 
-	client.dtlsConfig = &dtls.Config{
-		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
-		PSK:                  client.psk,
-		PSKIdentityHint:      []byte(cfg.PSKIdentity),
-		MTU:                  cfg.MTU,
-		CipherSuites:         cfg.CipherSuites,
-		EllipticCurves:       cfg.EllipticCurves,
-	}
-	if cfg.EnableCID {
-		client.dtlsConfig.ConnectionIDGenerator = dtls.OnlySendCIDGenerator()
-	}
-
 	lc := udp.ListenConfig{
 		Backlog: Backlog,
 	}
@@ -80,21 +189,52 @@ func New(cfg *Config) (*Client, error) {
 
 	client.listener = listener
 
+	if client.warmPool != nil {
+		client.workerWG.Add(1)
+		go func() {
+			defer client.workerWG.Done()
+			client.warmPool.run()
+		}()
+	}
 	go client.listen()
 
 	return client, nil
 }
 
+// Reload applies PSKCallback, PSKIdentity, Certificates, RootCAs,
+// ServerName, PinnedSPKI, MTU, CipherSuites, EllipticCurves, EnableCID,
+// SessionStore, IdleTimeout, TimeLimitFunc and AllowFunc from cfg to sessions
+// established after the call. Other fields of cfg are ignored. Warm pool
+// connections established with previous settings are dropped.
+func (client *Client) Reload(cfg *Config) error {
+	cfg = cfg.populateDefaults()
+	cfg.Multiplex = 0
+	if client.muxPool != nil {
+		cfg.Multiplex = len(client.muxPool.slots)
+	}
+	cfg.UpstreamAffinity = client.tokens != nil
+	cfg.Padding = client.padding
+	cfg.Chaff = client.chaff
+	cfg.Keepalive = client.keepalive
+	cfg.HandshakeProfile = client.profile
+	client.settings.Store(settingsFromConfig(cfg))
+	if client.warmPool != nil {
+		client.warmPool.flush()
+	}
+	return nil
+}
+
 func (client *Client) listen() {
 	defer client.Close()
 	for client.baseCtx.Err() == nil {
 		conn, err := client.listener.Accept()
 		if err != nil {
-			log.Printf("conn accept failed: %v", err)
+			client.logger.Warn("conn accept failed", util.ErrorAttrs(err)...)
 			continue
 		}
 
-		if !client.allowFunc(conn.RemoteAddr()) {
+		if !client.settings.Load().allowFunc(conn.RemoteAddr()) {
+			metrics.RateLimitRejections.With("client").Inc()
 			continue
 		}
 
@@ -108,52 +248,289 @@ func (client *Client) listen() {
 }
 
 func (client *Client) serve(conn net.Conn) {
-	log.Printf("[+] conn %s <=> %s", conn.LocalAddr(), conn.RemoteAddr())
-	defer log.Printf("[-] conn %s <=> %s", conn.LocalAddr(), conn.RemoteAddr())
 	defer conn.Close()
 
+	current := client.settings.Load()
 	ctx := client.baseCtx
-	tl := client.timeLimitFunc()
-	if tl != 0 {
+	tl := current.timeLimitFunc()
+	rotate := tl != 0 && client.rotationLead > 0 && client.rotationLead < tl
+	if tl != 0 && !rotate {
 		newCtx, cancel := context.WithTimeout(ctx, tl)
 		defer cancel()
 		ctx = newCtx
 	}
 
-	remoteConn, err := func() (net.Conn, error) {
-		dialCtx, cancel := context.WithTimeout(ctx, client.timeout)
-		defer cancel()
-		remoteConn, remoteAddr, err := client.remoteDialFn(dialCtx)
-		if err != nil {
-			return nil, fmt.Errorf("remote dial function failed: %w", err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	identity := string(current.dtlsConfig.PSKIdentityHint)
+	sess := session.New(
+		"client",
+		conn.LocalAddr().String(),
+		conn.RemoteAddr().String(),
+		identity,
+		"",
+		cancel,
+	)
+	sessLogger := util.ConnLogger(client.logger, conn).With(
+		slog.String(util.LogKeyIdentity, identity),
+		slog.String(util.LogKeySession, sess.ID()),
+	)
+
+	var remoteConn net.Conn
+	var err error
+	if client.muxPool != nil {
+		remoteConn, err = client.muxPool.open(sessLogger)
+	} else if warm := client.claimWarm(); warm != nil {
+		remoteConn = warm
+	} else {
+		remoteConn, err = client.dialRemote(ctx, sessLogger, current.dtlsConfig)
+	}
+	if err != nil {
+		sessLogger.Warn("remote dial failed", util.ErrorAttrs(err)...)
+		return
+	}
+	defer remoteConn.Close()
+	var token []byte
+	if client.tokens != nil {
+		token = client.tokens.Token(conn.RemoteAddr())
+		if err := sendToken(remoteConn, token); err != nil {
+			sessLogger.Warn("remote write failed", util.ErrorAttrs(err)...)
+			return
 		}
+	}
+
+	logger := sessLogger.With(slog.String(util.LogKeyEndpoint, remoteConn.RemoteAddr().String()))
+	logger.Info("session started")
+	defer logger.Info("session closed")
+	sess.SetUpstream(remoteConn.RemoteAddr().String())
+	client.sessions.Add(sess)
+	defer client.sessions.Remove(sess)
 
-		dtlsConn, err := dtls.Client(remoteConn, remoteAddr, client.dtlsConfig)
+	if rotate {
+		sc := newSwitchConn(remoteConn)
+		defer sc.Close()
+		remoteConn = sc
+		client.workerWG.Add(1)
+		go func() {
+			defer client.workerWG.Done()
+			client.rotate(ctx, sessLogger, cancel, sc, sess, tl, token)
+		}()
+	}
+
+	if client.keepalive > 0 {
+		kc := newKeepaliveConn(remoteConn)
+		remoteConn = kc
+		go kc.run(ctx, client.keepalive)
+	}
+
+	activeSessions := metrics.ActiveSessions.With("client")
+	activeSessions.Inc()
+	defer activeSessions.Dec()
+
+	util.PairConn(ctx, logger, conn, remoteConn, current.idleTimeout, client.staleMode, client.pairStats, sess.Stats())
+}
+
+func (client *Client) dialRemote(ctx context.Context, logger *slog.Logger, dtlsConfig *dtls.Config) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, client.timeout)
+	defer cancel()
+	remoteConn, remoteAddr, err := client.remoteDialFn(dialCtx)
+	if err != nil {
+		return nil, fmt.Errorf("remote dial function failed: %w", err)
+	}
+
+	if err := client.knock(dialCtx, remoteConn, remoteAddr, dtlsConfig); err != nil {
+		remoteConn.Close()
+		return nil, err
+	}
+
+	if client.hopInterval != nil {
+		hc := newHopConn(remoteConn, remoteAddr)
+		remoteConn = hc
+		client.workerWG.Add(1)
+		go func() {
+			defer client.workerWG.Done()
+			client.hop(logger, hc)
+		}()
+	}
+
+	if client.profile != nil {
+		remoteConn = client.profile.NewPacketConn(remoteConn)
+	}
+
+	dtlsConn, err := dtls.Client(remoteConn, remoteAddr, dtlsConfig)
+	if err != nil {
+		remoteConn.Close()
+		return nil, fmt.Errorf("DTLS connection with remote server failed: %w", err)
+	}
+
+	if err := dtlsConn.HandshakeContext(dialCtx); err != nil {
+		metrics.Handshakes.With("client", "failure", util.HandshakeFailureReason(err)).Inc()
+		dtlsConn.Close()
+		remoteConn.Close()
+		return nil, fmt.Errorf("DTLS handshake with remote server failed: %w", err)
+	}
+
+	metrics.Handshakes.With("client", "success", "").Inc()
+	conn, err := client.wrapConn(dtlsConn, dtlsConfig.MTU)
+	if err != nil {
+		dtlsConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// wrapConn adds padding and chaff layers to DTLS connection. Each layer
+// handles its part of negotiated protocol. Keepalives are sent by
+// session, so only their part of negotiated protocol is stripped here.
+func (client *Client) wrapConn(conn net.Conn, mtu int) (net.Conn, error) {
+	if client.padding != nil {
+		if _, padded := padding.SplitProtocol(negotiatedProtocol(conn)); !padded {
+			return nil, errors.New("server doesn't support padding")
+		}
+		conn = padding.NewConn(conn, client.padding, padding.MaxSize(mtu))
+	}
+	if client.chaff != nil {
+		if _, ok := chaff.SplitProtocol(negotiatedProtocol(conn)); !ok {
+			return nil, errors.New("server doesn't support chaff")
+		}
+		cc := chaff.NewConn(conn, "client", client.chaff, client.chaffBudget)
+		go cc.Run()
+		conn = cc
+	}
+	if client.keepalive > 0 {
+		if _, ok := util.SplitKeepaliveProtocol(negotiatedProtocol(conn)); !ok {
+			return nil, errors.New("server doesn't support keepalives")
+		}
+		conn = keepaliveProtocolConn{conn}
+	}
+	return conn, nil
+}
+
+// sendToken sends session token if server accepted it in handshake.
+func sendToken(conn net.Conn, token []byte) error {
+	if token == nil {
+		return nil
+	}
+	if negotiatedProtocol(conn) == affinity.Protocol {
+		return affinity.WriteToken(conn, token)
+	}
+	return nil
+}
+
+func negotiatedProtocol(conn net.Conn) string {
+	if stater, ok := conn.(interface {
+		ConnectionState() (dtls.State, bool)
+	}); ok {
+		if state, ok := stater.ConnectionState(); ok {
+			return state.NegotiatedProtocol
+		}
+	}
+	return ""
+}
+
+func (client *Client) claimWarm() net.Conn {
+	if client.warmPool == nil {
+		return nil
+	}
+	return client.warmPool.get()
+}
+
+// rotate replaces DTLS connection of session with a fresh one rotationLead
+// before time limit of current connection expires. If replacement
+// connection can't be established, session is terminated when time limit
+// expires. Replacement connection carries the same session token.
+func (client *Client) rotate(ctx context.Context, logger *slog.Logger, cancel func(), remote *switchConn, sess *session.Session, tl time.Duration, token []byte) {
+	for {
+		deadline := time.Now().Add(tl)
+		if !sleepCtx(ctx, tl-client.rotationLead) {
+			return
+		}
+
+		current := client.settings.Load()
+		newConn, err := client.dialRemote(ctx, logger, current.dtlsConfig)
+		if err == nil {
+			if err = sendToken(newConn, token); err != nil {
+				newConn.Close()
+			}
+		}
 		if err != nil {
-			remoteConn.Close()
-			return nil, fmt.Errorf("DTLS connection with remote server failed: %w", err)
+			logger.Warn("session rotation failed",
+				append([]any{slog.String(util.LogKeyEndpoint, remote.RemoteAddr().String())}, util.ErrorAttrs(err)...)...)
+			if sleepCtx(ctx, time.Until(deadline)) {
+				cancel()
+			}
+			return
 		}
+		logger.Info("session rotated",
+			slog.String(util.LogKeyEndpoint, remote.RemoteAddr().String()),
+			slog.String("new_endpoint", newConn.RemoteAddr().String()))
+		remote.Switch(newConn, time.Until(deadline))
+		sess.SetUpstream(newConn.RemoteAddr().String())
 
-		if err := dtlsConn.HandshakeContext(dialCtx); err != nil {
-			dtlsConn.Close()
-			remoteConn.Close()
-			return nil, fmt.Errorf("DTLS handshake with remote server failed: %w", err)
+		tl = current.timeLimitFunc()
+		switch {
+		case tl == 0:
+			return
+		case tl <= client.rotationLead:
+			if sleepCtx(ctx, tl) {
+				cancel()
+			}
+			return
 		}
+	}
+}
 
-		return dtlsConn, nil
-	}()
-	if err != nil {
-		log.Printf("remote dial failed: %v", err)
-		return
+// hop moves DTLS connection to a new endpoint obtained from remoteDialFn
+// on each hop interval until connection is closed. Server keeps track of
+// the session by connection ID. Hopping stops when client is closed.
+func (client *Client) hop(logger *slog.Logger, conn *hopConn) {
+	for {
+		interval := client.hopInterval()
+		if interval <= 0 {
+			return
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-conn.Done():
+			timer.Stop()
+			return
+		case <-client.baseCtx.Done():
+			timer.Stop()
+			return
+		}
+
+		dialCtx, cancel := context.WithTimeout(client.baseCtx, client.timeout)
+		newConn, newAddr, err := client.remoteDialFn(dialCtx)
+		cancel()
+		if err != nil {
+			logger.Warn("endpoint hop failed", util.ErrorAttrs(err)...)
+			continue
+		}
+		logger.Info("endpoint hop",
+			slog.String(util.LogKeyEndpoint, conn.RemoteAddr().String()),
+			slog.String("new_endpoint", newAddr.String()))
+		conn.Hop(newConn, newAddr, client.timeout)
 	}
-	defer remoteConn.Close()
+}
 
-	util.PairConn(ctx, conn, remoteConn, client.idleTimeout, client.staleMode)
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 func (client *Client) Close() error {
 	client.cancelCtx()
 	err := client.listener.Close()
+	if client.muxPool != nil {
+		client.muxPool.close()
+	}
 	client.workerWG.Wait()
 	return err
 }
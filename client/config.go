@@ -2,28 +2,56 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
 	"net"
 	"time"
 
+	"github.com/SenseUnit/dtlspipe/chaff"
 	"github.com/SenseUnit/dtlspipe/ciphers"
+	"github.com/SenseUnit/dtlspipe/hsprofile"
+	"github.com/SenseUnit/dtlspipe/padding"
+	"github.com/SenseUnit/dtlspipe/session"
 	"github.com/SenseUnit/dtlspipe/util"
+	"github.com/pion/dtls/v3"
 )
 
 type Config struct {
-	BindAddress    string
-	RemoteDialFunc func(ctx context.Context) (net.PacketConn, net.Addr, error)
-	Timeout        time.Duration
-	IdleTimeout    time.Duration
-	BaseContext    context.Context
-	PSKCallback    func([]byte) ([]byte, error)
-	PSKIdentity    string
-	MTU            int
-	CipherSuites   ciphers.CipherList
-	EllipticCurves ciphers.CurveList
-	StaleMode      util.StaleMode
-	TimeLimitFunc  func() time.Duration
-	AllowFunc      func(net.Addr) bool
-	EnableCID      bool
+	BindAddress      string
+	RemoteDialFunc   func(ctx context.Context) (net.PacketConn, net.Addr, error)
+	Timeout          time.Duration
+	IdleTimeout      time.Duration
+	BaseContext      context.Context
+	PSKCallback      func([]byte) ([]byte, error)
+	PSKIdentity      string
+	Certificates     []tls.Certificate
+	RootCAs          *x509.CertPool
+	ServerName       string
+	PinnedSPKI       [][]byte
+	MTU              int
+	CipherSuites     ciphers.CipherList
+	EllipticCurves   ciphers.CurveList
+	StaleMode        util.StaleMode
+	TimeLimitFunc    func() time.Duration
+	RotationLeadTime time.Duration
+	HopIntervalFunc  func() time.Duration
+	Keepalive        time.Duration
+	AllowFunc        func(net.Addr) bool
+	EnableCID        bool
+	SessionStore     dtls.SessionStore
+	UpstreamAffinity bool
+	Multiplex        int
+	Padding          padding.Distribution
+	Chaff            chaff.Schedule
+	ChaffBudget      int
+	HandshakeProfile *hsprofile.Profile
+	Knock            bool
+	KnockPorts       []uint16
+	WarmPoolSize     int
+	WarmPoolTTL      time.Duration
+	Sessions         *session.Registry
+	Logger           *slog.Logger
 }
 
 func (cfg *Config) populateDefaults() *Config {
@@ -36,8 +64,17 @@ func (cfg *Config) populateDefaults() *Config {
 	if cfg.IdleTimeout == 0 {
 		cfg.IdleTimeout = 90 * time.Second
 	}
+	if cfg.ChaffBudget == 0 {
+		cfg.ChaffBudget = chaff.DefaultBudget
+	}
+	if cfg.WarmPoolTTL == 0 {
+		cfg.WarmPoolTTL = cfg.IdleTimeout / 2
+	}
 	if cfg.CipherSuites == nil {
 		cfg.CipherSuites = ciphers.DefaultCipherList
+		if cfg.PSKCallback == nil {
+			cfg.CipherSuites = ciphers.DefaultCertCipherList
+		}
 	}
 	if cfg.EllipticCurves == nil {
 		cfg.EllipticCurves = ciphers.DefaultCurveList
@@ -48,5 +85,11 @@ func (cfg *Config) populateDefaults() *Config {
 	if cfg.AllowFunc == nil {
 		cfg.AllowFunc = util.AllowAllFunc
 	}
+	if cfg.Sessions == nil {
+		cfg.Sessions = session.NewRegistry()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
 	return cfg
 }
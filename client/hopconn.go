@@ -0,0 +1,214 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type packetResult struct {
+	data []byte
+	addr net.Addr
+	err  error
+	conn net.PacketConn
+}
+
+// hopConn is a net.PacketConn which sends all datagrams to the current
+// remote address via current underlying socket. Both of them can be
+// replaced at any time, allowing DTLS connection with connection ID
+// extension to migrate to another endpoint.
+type hopConn struct {
+	mux           sync.Mutex
+	conn          net.PacketConn
+	rAddr         net.Addr
+	conns         map[net.PacketConn]struct{}
+	readDeadline  time.Time
+	deadlineCh    chan struct{}
+	writeDeadline time.Time
+	readCh        chan packetResult
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newHopConn(conn net.PacketConn, rAddr net.Addr) *hopConn {
+	c := &hopConn{
+		conn:       conn,
+		rAddr:      rAddr,
+		conns:      map[net.PacketConn]struct{}{conn: {}},
+		deadlineCh: make(chan struct{}),
+		readCh:     make(chan packetResult),
+		closed:     make(chan struct{}),
+	}
+	go c.reader(conn)
+	return c
+}
+
+func (c *hopConn) reader(conn net.PacketConn) {
+	buf := make([]byte, MaxPktBuf)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		res := packetResult{
+			addr: addr,
+			err:  err,
+			conn: conn,
+		}
+		if err == nil {
+			res.data = bytes.Clone(buf[:n])
+		}
+		select {
+		case c.readCh <- res:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Hop makes conn and rAddr current socket and destination address.
+// Previous socket is still read for retireAfter duration and closed
+// afterwards.
+func (c *hopConn) Hop(conn net.PacketConn, rAddr net.Addr, retireAfter time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	select {
+	case <-c.closed:
+		conn.Close()
+		return
+	default:
+	}
+	if !c.writeDeadline.IsZero() {
+		conn.SetWriteDeadline(c.writeDeadline)
+	}
+	old := c.conn
+	c.conn = conn
+	c.rAddr = rAddr
+	c.conns[conn] = struct{}{}
+	go c.reader(conn)
+	time.AfterFunc(retireAfter, func() {
+		c.mux.Lock()
+		delete(c.conns, old)
+		c.mux.Unlock()
+		old.Close()
+	})
+}
+
+func (c *hopConn) Done() <-chan struct{} {
+	return c.closed
+}
+
+func (c *hopConn) current() (net.PacketConn, net.Addr) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.conn, c.rAddr
+}
+
+func (c *hopConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mux.Lock()
+		deadline := c.readDeadline
+		deadlineCh := c.deadlineCh
+		c.mux.Unlock()
+
+		res, err := c.readResult(deadline, deadlineCh)
+		if err != nil {
+			return 0, nil, err
+		}
+		if res == nil {
+			// deadline changed
+			continue
+		}
+		if res.err != nil {
+			if conn, _ := c.current(); res.conn == conn {
+				return 0, nil, res.err
+			}
+			// retired socket
+			continue
+		}
+		return copy(b, res.data), res.addr, nil
+	}
+}
+
+func (c *hopConn) readResult(deadline time.Time, deadlineCh <-chan struct{}) (*packetResult, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case res := <-c.readCh:
+		return &res, nil
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-deadlineCh:
+		return nil, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// WriteTo sends datagram to current remote address, ignoring addr.
+func (c *hopConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	conn, rAddr := c.current()
+	return conn.WriteTo(b, rAddr)
+}
+
+func (c *hopConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		close(c.closed)
+		for conn := range c.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+func (c *hopConn) LocalAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.LocalAddr()
+}
+
+func (c *hopConn) RemoteAddr() net.Addr {
+	_, rAddr := c.current()
+	return rAddr
+}
+
+func (c *hopConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *hopConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.readDeadline = t
+	close(c.deadlineCh)
+	c.deadlineCh = make(chan struct{})
+	return nil
+}
+
+func (c *hopConn) SetWriteDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func listenLoopback(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	return conn
+}
+
+func TestHopConn(t *testing.T) {
+	peer := listenLoopback(t)
+	defer peer.Close()
+
+	hc := newHopConn(listenLoopback(t), peer.LocalAddr())
+	defer hc.Close()
+
+	buf := make([]byte, 16)
+	if _, err := hc.WriteTo([]byte("first"), nil); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	n, firstAddr, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "first" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+
+	hc.Hop(listenLoopback(t), peer.LocalAddr(), time.Second)
+
+	if _, err := hc.WriteTo([]byte("second"), nil); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	n, secondAddr, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "second" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+	if firstAddr.String() == secondAddr.String() {
+		t.Fatalf("source address didn't change after hop: %s", secondAddr)
+	}
+
+	// packets sent to retired socket are still delivered within grace period
+	for _, addr := range []net.Addr{firstAddr, secondAddr} {
+		peer.WriteTo([]byte("reply"), addr)
+		hc.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _, err := hc.ReadFrom(buf); err != nil || string(buf[:n]) != "reply" {
+			t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+		}
+	}
+
+	// deadline change interrupts blocked read
+	hc.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		hc.SetReadDeadline(time.Unix(1, 0))
+	}()
+	if _, _, err := hc.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	hc.Close()
+	if _, _, err := hc.ReadFrom(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+}
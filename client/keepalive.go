@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/util"
+	"github.com/pion/dtls/v3"
+)
+
+// keepaliveConn sends keepalive datagrams when nothing was written to
+// connection for keepalive interval, so NAT bindings on the way to server
+// are not dropped. Server discards keepalives, so they don't affect
+// stale detection.
+type keepaliveConn struct {
+	net.Conn
+	lastWrite atomic.Int64
+}
+
+func newKeepaliveConn(conn net.Conn) *keepaliveConn {
+	c := &keepaliveConn{Conn: conn}
+	c.lastWrite.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *keepaliveConn) Write(b []byte) (int, error) {
+	c.lastWrite.Store(time.Now().UnixNano())
+	return c.Conn.Write(b)
+}
+
+// run sends keepalives until ctx is done or write fails.
+func (c *keepaliveConn) run(ctx context.Context, interval time.Duration) {
+	sent := metrics.Keepalives.With("client")
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		idle := time.Since(time.Unix(0, c.lastWrite.Load()))
+		if idle >= interval {
+			if _, err := c.Write(util.KeepaliveDatagram); err != nil {
+				return
+			}
+			sent.Inc()
+			idle = 0
+		}
+		timer.Reset(interval - idle)
+	}
+}
+
+// keepaliveProtocolConn hides keepalive part of negotiated protocol from
+// multiplexing and session affinity layers.
+type keepaliveProtocolConn struct {
+	net.Conn
+}
+
+func (c keepaliveProtocolConn) ConnectionState() (dtls.State, bool) {
+	stater, ok := c.Conn.(interface {
+		ConnectionState() (dtls.State, bool)
+	})
+	if !ok {
+		return dtls.State{}, false
+	}
+	state, ok := stater.ConnectionState()
+	state.NegotiatedProtocol, _ = util.SplitKeepaliveProtocol(state.NegotiatedProtocol)
+	return state, ok
+}
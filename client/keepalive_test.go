@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+func TestKeepaliveConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	kc := newKeepaliveConn(local)
+	defer kc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go kc.run(ctx, 100*time.Millisecond)
+
+	received := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	// keepalives are not sent while there is traffic
+	for i := 0; i < 4; i++ {
+		if _, err := kc.Write([]byte("data")); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if b := <-received; string(b) != "data" {
+			t.Fatalf("unexpected datagram %q", b)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case b := <-received:
+		if !util.IsKeepalive(b) {
+			t.Fatalf("unexpected datagram %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("keepalive is not sent")
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/knock"
+	"github.com/SenseUnit/dtlspipe/randpool"
+	"github.com/pion/dtls/v3"
+)
+
+const (
+	// knockInterval separates knocks, so they arrive to server in order.
+	// Server holds handshake datagrams until knock datagram is verified,
+	// so interval doesn't have to cover slow key lookups.
+	knockInterval = 20 * time.Millisecond
+
+	minKnockSize = 16
+	maxKnockSize = 64
+)
+
+// knock sends knock sequence over knockPorts of server host and then
+// knock datagram authenticated with pre-shared key, if enabled.
+func (client *Client) knock(ctx context.Context, conn net.PacketConn, rAddr net.Addr, dtlsConfig *dtls.Config) error {
+	if len(client.knockPorts) > 0 {
+		udpAddr, ok := rAddr.(*net.UDPAddr)
+		if !ok {
+			return errors.New("knock sequence requires UDP remote address")
+		}
+		for _, port := range client.knockPorts {
+			addr := &net.UDPAddr{IP: udpAddr.IP, Port: int(port), Zone: udpAddr.Zone}
+			if _, err := conn.WriteTo(randomDatagram(), addr); err != nil {
+				return fmt.Errorf("can't send knock: %w", err)
+			}
+			if !sleepCtx(ctx, knockInterval) {
+				return ctx.Err()
+			}
+		}
+	}
+	if !client.knockPSK {
+		return nil
+	}
+	psk, err := dtlsConfig.PSK(nil)
+	if err != nil {
+		return fmt.Errorf("can't get key for knock: %w", err)
+	}
+	pkt, err := knock.New(dtlsConfig.PSKIdentityHint, psk)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(pkt, rAddr); err != nil {
+		return fmt.Errorf("can't send knock: %w", err)
+	}
+	if !sleepCtx(ctx, knockInterval) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func randomDatagram() []byte {
+	var datagram []byte
+	randpool.Borrow(func(r *rand.Rand) {
+		datagram = make([]byte, minKnockSize+r.Intn(maxKnockSize-minKnockSize+1))
+		r.Read(datagram)
+	})
+	return datagram
+}
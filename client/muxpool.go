@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/SenseUnit/dtlspipe/flowmux"
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+// muxPool keeps a fixed number of multiplexed DTLS connections carrying
+// sessions as flows. Connections are established on demand and replaced
+// once closed.
+type muxPool struct {
+	client *Client
+	next   atomic.Uint32
+	slots  []muxSlot
+}
+
+type muxSlot struct {
+	mux    sync.Mutex
+	conn   *flowmux.Conn
+	closed bool
+}
+
+func newMuxPool(client *Client, size int) *muxPool {
+	return &muxPool{
+		client: client,
+		slots:  make([]muxSlot, size),
+	}
+}
+
+// open opens new flow in one of pool connections.
+func (p *muxPool) open(logger *slog.Logger) (net.Conn, error) {
+	slot := &p.slots[int(p.next.Add(1)-1)%len(p.slots)]
+	slot.mux.Lock()
+	defer slot.mux.Unlock()
+	if slot.closed {
+		return nil, net.ErrClosed
+	}
+	if slot.conn != nil {
+		select {
+		case <-slot.conn.Done():
+			slot.conn = nil
+		default:
+		}
+	}
+	if slot.conn == nil {
+		conn, err := p.dial(logger)
+		if err != nil {
+			return nil, err
+		}
+		slot.conn = conn
+	}
+	return slot.conn.Open()
+}
+
+func (p *muxPool) dial(logger *slog.Logger) (*flowmux.Conn, error) {
+	current := p.client.settings.Load()
+	conn, err := p.client.dialRemote(p.client.baseCtx, logger, current.dtlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if negotiatedProtocol(conn) != flowmux.Protocol {
+		conn.Close()
+		return nil, errors.New("server doesn't support multiplexing")
+	}
+	mc := flowmux.Client(conn, current.idleTimeout)
+	connLogger := p.client.logger.With(slog.String(util.LogKeyEndpoint, mc.RemoteAddr().String()))
+	connLogger.Info("multiplexed connection started")
+	go func() {
+		<-mc.Done()
+		connLogger.Info("multiplexed connection closed")
+	}()
+	return mc, nil
+}
+
+func (p *muxPool) close() {
+	for i := range p.slots {
+		slot := &p.slots[i]
+		slot.mux.Lock()
+		slot.closed = true
+		if slot.conn != nil {
+			slot.conn.Close()
+		}
+		slot.mux.Unlock()
+	}
+}
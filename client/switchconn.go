@@ -0,0 +1,165 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type readResult struct {
+	data []byte
+	err  error
+	conn net.Conn
+}
+
+// switchConn is a net.Conn which writes into current underlying
+// connection and reads from all underlying connections not retired yet.
+// It allows to replace connection without interruption of datagram flow.
+type switchConn struct {
+	mux          sync.Mutex
+	current      net.Conn
+	conns        map[net.Conn]struct{}
+	readDeadline time.Time
+	readCh       chan readResult
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func newSwitchConn(conn net.Conn) *switchConn {
+	c := &switchConn{
+		current: conn,
+		conns:   map[net.Conn]struct{}{conn: {}},
+		readCh:  make(chan readResult),
+		closed:  make(chan struct{}),
+	}
+	go c.reader(conn)
+	return c
+}
+
+func (c *switchConn) reader(conn net.Conn) {
+	buf := make([]byte, MaxPktBuf)
+	for {
+		n, err := conn.Read(buf)
+		res := readResult{
+			err:  err,
+			conn: conn,
+		}
+		if err == nil {
+			res.data = bytes.Clone(buf[:n])
+		}
+		select {
+		case c.readCh <- res:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Switch makes conn current connection. Previous connection is still read
+// for retireAfter duration and closed afterwards.
+func (c *switchConn) Switch(conn net.Conn, retireAfter time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	select {
+	case <-c.closed:
+		conn.Close()
+		return
+	default:
+	}
+	old := c.current
+	c.current = conn
+	c.conns[conn] = struct{}{}
+	go c.reader(conn)
+	time.AfterFunc(retireAfter, func() {
+		c.mux.Lock()
+		delete(c.conns, old)
+		c.mux.Unlock()
+		old.Close()
+	})
+}
+
+func (c *switchConn) currentConn() net.Conn {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.current
+}
+
+func (c *switchConn) Read(b []byte) (int, error) {
+	c.mux.Lock()
+	deadline := c.readDeadline
+	c.mux.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case res := <-c.readCh:
+			if res.err != nil {
+				if res.conn == c.currentConn() {
+					return 0, res.err
+				}
+				// retired connection
+				continue
+			}
+			return copy(b, res.data), nil
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (c *switchConn) Write(b []byte) (int, error) {
+	return c.currentConn().Write(b)
+}
+
+func (c *switchConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		close(c.closed)
+		for conn := range c.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+func (c *switchConn) LocalAddr() net.Addr {
+	return c.currentConn().LocalAddr()
+}
+
+func (c *switchConn) RemoteAddr() net.Addr {
+	return c.currentConn().RemoteAddr()
+}
+
+// SetDeadline sets read deadline for subsequent Read calls and write
+// deadline of current connection.
+func (c *switchConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets deadline for subsequent Read calls. Read already in
+// progress is not affected.
+func (c *switchConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *switchConn) SetWriteDeadline(t time.Time) error {
+	return c.currentConn().SetWriteDeadline(t)
+}
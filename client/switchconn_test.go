@@ -0,0 +1,50 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSwitchConn(t *testing.T) {
+	oldLocal, oldRemote := net.Pipe()
+	newLocal, newRemote := net.Pipe()
+	defer oldRemote.Close()
+	defer newRemote.Close()
+
+	sc := newSwitchConn(oldLocal)
+	defer sc.Close()
+
+	buf := make([]byte, 16)
+	go oldRemote.Write([]byte("old"))
+	if n, err := sc.Read(buf); err != nil || string(buf[:n]) != "old" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+
+	sc.Switch(newLocal, 100*time.Millisecond)
+
+	go func() {
+		b := make([]byte, 16)
+		n, _ := newRemote.Read(b)
+		newRemote.Write(b[:n])
+	}()
+	if _, err := sc.Write([]byte("new")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if n, err := sc.Read(buf); err != nil || string(buf[:n]) != "new" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+
+	go oldRemote.Write([]byte("late"))
+	if n, err := sc.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("unexpected read from retiring conn: %q, %v", buf[:n], err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	sc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := sc.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error after old conn retirement, got %v", err)
+	}
+}
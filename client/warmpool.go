@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+type warmConn struct {
+	conn    net.Conn
+	expires time.Time
+}
+
+// warmPool keeps DTLS connections established in advance, so new
+// sessions don't wait for handshake. Connections not claimed within ttl
+// are replaced before server drops them as idle.
+type warmPool struct {
+	client *Client
+	dial   func(ctx context.Context) (net.Conn, error)
+	size   int
+	ttl    time.Duration
+
+	mux        sync.Mutex
+	conns      []warmConn
+	generation uint64
+	wakeup     chan struct{}
+}
+
+func newWarmPool(client *Client, size int, ttl time.Duration) *warmPool {
+	return &warmPool{
+		client: client,
+		dial: func(ctx context.Context) (net.Conn, error) {
+			return client.dialRemote(ctx, client.logger, client.settings.Load().dtlsConfig)
+		},
+		size:   size,
+		ttl:    ttl,
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+// get returns ready connection or nil if there is none.
+func (p *warmPool) get() net.Conn {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	defer p.notify()
+	now := time.Now()
+	for len(p.conns) > 0 {
+		wc := p.conns[0]
+		p.conns = p.conns[1:]
+		if now.Before(wc.expires) {
+			return wc.conn
+		}
+		wc.conn.Close()
+	}
+	return nil
+}
+
+// flush drops all ready connections, so new ones are established with
+// current settings.
+func (p *warmPool) flush() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.generation++
+	for _, wc := range p.conns {
+		wc.conn.Close()
+	}
+	p.conns = nil
+	p.notify()
+}
+
+func (p *warmPool) notify() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps pool filled until client is closed.
+func (p *warmPool) run() {
+	defer p.flush()
+	ctx := p.client.baseCtx
+	logger := p.client.logger
+	for ctx.Err() == nil {
+		p.mux.Lock()
+		p.expireLocked()
+		missing := p.size - len(p.conns)
+		generation := p.generation
+		var nextExpiry time.Duration
+		if len(p.conns) > 0 {
+			nextExpiry = time.Until(p.conns[0].expires)
+		}
+		p.mux.Unlock()
+
+		if missing > 0 {
+			conn, err := p.dial(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Warn("warm pool dial failed", util.ErrorAttrs(err)...)
+					sleepCtx(ctx, p.client.timeout)
+				}
+				continue
+			}
+			p.mux.Lock()
+			if p.generation != generation || ctx.Err() != nil {
+				conn.Close()
+			} else {
+				p.conns = append(p.conns, warmConn{
+					conn:    conn,
+					expires: time.Now().Add(p.ttl),
+				})
+			}
+			p.mux.Unlock()
+			continue
+		}
+
+		timer := time.NewTimer(nextExpiry)
+		select {
+		case <-timer.C:
+		case <-p.wakeup:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+}
+
+func (p *warmPool) expireLocked() {
+	now := time.Now()
+	for len(p.conns) > 0 && !now.Before(p.conns[0].expires) {
+		p.conns[0].conn.Close()
+		p.conns = p.conns[1:]
+	}
+}
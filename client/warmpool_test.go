@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stubConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *stubConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// stubDialer counts dials and blocks them until released.
+type stubDialer struct {
+	mux     sync.Mutex
+	conns   []*stubConn
+	release chan struct{}
+}
+
+func (d *stubDialer) dial(ctx context.Context) (net.Conn, error) {
+	if d.release != nil {
+		select {
+		case <-d.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	conn := new(stubConn)
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+func (d *stubDialer) dials() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return len(d.conns)
+}
+
+func (d *stubDialer) conn(i int) *stubConn {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.conns[i]
+}
+
+func startWarmPool(t *testing.T, d *stubDialer, size int, ttl time.Duration) *warmPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		baseCtx: ctx,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		timeout: 10 * time.Millisecond,
+	}
+	p := newWarmPool(client, size, ttl)
+	p.dial = d.dial
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run()
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return p
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (p *warmPool) ready() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return len(p.conns)
+}
+
+func TestWarmPoolRefill(t *testing.T) {
+	d := new(stubDialer)
+	p := startWarmPool(t, d, 2, time.Minute)
+	waitFor(t, func() bool { return p.ready() == 2 })
+
+	conn := p.get()
+	if conn != d.conn(0) {
+		t.Fatal("pool didn't return the oldest connection")
+	}
+	waitFor(t, func() bool { return p.ready() == 2 })
+	if n := d.dials(); n != 3 {
+		t.Errorf("unexpected number of dials after claim: %d", n)
+	}
+	if conn.(*stubConn).closed.Load() {
+		t.Error("claimed connection is closed")
+	}
+}
+
+func TestWarmPoolExpiry(t *testing.T) {
+	d := new(stubDialer)
+	p := startWarmPool(t, d, 1, 50*time.Millisecond)
+	waitFor(t, func() bool { return p.ready() == 1 })
+	expired := d.conn(0)
+	waitFor(t, func() bool { return d.dials() == 2 && p.ready() == 1 })
+	if !expired.closed.Load() {
+		t.Error("expired connection is not closed")
+	}
+
+	// connection which expires before claim is not returned
+	p.mux.Lock()
+	p.conns[0].expires = time.Now()
+	p.mux.Unlock()
+	stale := d.conn(1)
+	if conn := p.get(); conn == stale {
+		t.Error("expired connection is returned")
+	}
+	if !stale.closed.Load() {
+		t.Error("expired connection is not closed")
+	}
+}
+
+func TestWarmPoolFlush(t *testing.T) {
+	d := &stubDialer{release: make(chan struct{})}
+	p := startWarmPool(t, d, 1, time.Minute)
+	// ready connections are dropped
+	d.release <- struct{}{}
+	waitFor(t, func() bool { return p.ready() == 1 })
+	p.flush()
+	if p.ready() != 0 || !d.conn(0).closed.Load() {
+		t.Fatal("ready connection is not dropped by flush")
+	}
+
+	// connection dialed while flush happened is discarded as well
+	time.Sleep(20 * time.Millisecond)
+	p.flush()
+	d.release <- struct{}{}
+	waitFor(t, func() bool { return d.dials() == 2 })
+	waitFor(t, func() bool { return d.conn(1).closed.Load() })
+	if p.ready() != 0 {
+		t.Fatal("connection of previous generation is kept")
+	}
+	d.release <- struct{}{}
+	waitFor(t, func() bool { return p.ready() == 1 })
+	if conn := p.get(); conn != d.conn(2) {
+		t.Error("pool didn't return connection of current generation")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loadTunnelsFile reads tunnel declarations from file. Options not
+// specified for tunnel are taken from defaults.
+func loadTunnelsFile(filename string, defaults *tunnelOptions) ([]*tunnel, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't open config file: %w", err)
+	}
+	defer f.Close()
+	tunnels, err := parseTunnels(f, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("can't load config file %q: %w", filename, err)
+	}
+	return tunnels, nil
+}
+
+// parseTunnels reads tunnel declarations from TOML document. Each tunnel
+// is declared by table which name is the tunnel name. Keys "mode", "bind"
+// and "remote" specify tunnel mode (server, client or hoppingclient) and
+// its addresses. Key "remote" may be an array of strings to specify
+// multiple endpoint groups of hoppingclient. Other keys have the same
+// meaning as command line options.
+func parseTunnels(r io.Reader, defaults *tunnelOptions) ([]*tunnel, error) {
+	var doc map[string]any
+	md, err := toml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnels []*tunnel
+	for _, key := range md.Keys() {
+		if len(key) != 1 {
+			continue
+		}
+		name := key[0]
+		table, ok := doc[name].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("option %q outside of tunnel table", name)
+		}
+		if name == "" {
+			return nil, errors.New("empty tunnel name")
+		}
+		t, err := parseTunnel(name, table, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+		tunnels = append(tunnels, t)
+	}
+	if len(tunnels) == 0 {
+		return nil, errors.New("no tunnels defined")
+	}
+	return tunnels, nil
+}
+
+func parseTunnel(name string, table map[string]any, defaults *tunnelOptions) (*tunnel, error) {
+	opts := *defaults
+	t := &tunnel{
+		name: name,
+		opts: &opts,
+	}
+	switch remote := table["remote"].(type) {
+	case nil:
+	case string:
+		t.remotes = []string{remote}
+	case []any:
+		for _, elem := range remote {
+			s, ok := elem.(string)
+			if !ok {
+				return nil, errors.New("option \"remote\" must be a string or array of strings")
+			}
+			t.remotes = append(t.remotes, s)
+		}
+	default:
+		return nil, errors.New("option \"remote\" must be a string or array of strings")
+	}
+	delete(table, "remote")
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts.register(fs)
+	fs.StringVar(&t.mode, "mode", "", "")
+	fs.StringVar(&t.bind, "bind", "", "")
+	if err := setFlags(fs, table); err != nil {
+		return nil, err
+	}
+	// rate limiter inherited from defaults has to be replaced with
+	// a new one to keep limits of tunnels independent
+	if err := opts.rateLimit.Set(opts.rateLimit.String()); err != nil {
+		return nil, fmt.Errorf("bad rate limit: %w", err)
+	}
+	return t, nil
+}
+
+// setFlags sets flags of fs from values of TOML table. Strings are taken
+// as is, numbers and booleans are formatted the same way as they'd be
+// written on command line.
+func setFlags(fs *flag.FlagSet, table map[string]any) error {
+	for _, name := range slices.Sorted(maps.Keys(table)) {
+		var value string
+		switch v := table[name].(type) {
+		case string:
+			value = v
+		case int64:
+			value = strconv.FormatInt(v, 10)
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("option %q: unsupported value type %T", name, v)
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for option %q: %w", value, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTunnels(t *testing.T) {
+	defaults := newTunnelOptions()
+	defaults.pskHex = "00112233"
+	tunnels, err := parseTunnels(strings.NewReader(`
+# comment
+[srv]
+mode = "server"
+bind = "0.0.0.0:443"
+remote = "127.0.0.1:51820"
+idle-time = "1m"
+cid = true
+
+[hop]
+mode = "hoppingclient"
+bind = "127.0.0.1:2000"
+remote = ["example.org:20000-20100", "example.net:30000"]
+stale-mode = "both"
+`), defaults)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tunnels) != 2 {
+		t.Fatalf("unexpected number of tunnels: %d", len(tunnels))
+	}
+	srv, hop := tunnels[0], tunnels[1]
+	if srv.name != "srv" || srv.mode != modeServer || srv.bind != "0.0.0.0:443" || !slices.Equal(srv.remotes, []string{"127.0.0.1:51820"}) {
+		t.Errorf("unexpected server tunnel: %+v", srv)
+	}
+	if srv.opts.idleTime != time.Minute || srv.opts.pskHex != "00112233" || !srv.opts.connectionIDExt {
+		t.Errorf("unexpected server options: %+v", srv.opts)
+	}
+	if hop.mode != modeHoppingClient || !slices.Equal(hop.remotes, []string{"example.org:20000-20100", "example.net:30000"}) {
+		t.Errorf("unexpected hoppingclient tunnel: %+v", hop)
+	}
+	if hop.opts.idleTime != defaults.idleTime || hop.opts.staleMode.String() != "both" {
+		t.Errorf("unexpected hoppingclient options: %+v", hop.opts)
+	}
+	if srv.opts.rateLimit.value == hop.opts.rateLimit.value || srv.opts.rateLimit.value == defaults.rateLimit.value {
+		t.Errorf("rate limiter is shared between tunnels")
+	}
+}
+
+func TestParseTunnelsErrors(t *testing.T) {
+	for _, cfg := range []string{
+		"",
+		"mode = \"server\"",
+		"[a]\nmode = \"server\"\n[a]\nmode = \"client\"",
+		"[a\nmode = \"server\"",
+		"[\"\"]\nmode = \"server\"",
+		"[a]\nunknown = 1",
+		"[a]\nmode = server",
+		"[a]\nidle-time = \"1x\"",
+		"[a]\nremote = [1, 2]",
+		"[a]\nbind = [\"127.0.0.1:2000\"]",
+		"[a.b]\nmode = \"server\"",
+	} {
+		if _, err := parseTunnels(strings.NewReader(cfg), newTunnelOptions()); err == nil {
+			t.Errorf("config %q: expected error", cfg)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
@@ -14,18 +17,21 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/SenseUnit/dtlspipe/addrgen"
+	"github.com/SenseUnit/dtlspipe/admin"
 	"github.com/SenseUnit/dtlspipe/ciphers"
-	"github.com/SenseUnit/dtlspipe/client"
 	"github.com/SenseUnit/dtlspipe/keystore"
+	"github.com/SenseUnit/dtlspipe/metrics"
 	"github.com/SenseUnit/dtlspipe/server"
+	"github.com/SenseUnit/dtlspipe/session"
 	"github.com/SenseUnit/dtlspipe/util"
 	"github.com/Snawoot/rlzone"
 )
 
 const (
-	ProgName     = "dtlspipe"
-	PSKEnvVarKey = "DTLSPIPE_PSK"
+	ProgName                = "dtlspipe"
+	PSKEnvVarKey            = "DTLSPIPE_PSK"
+	CredentialsDirEnvVarKey = "CREDENTIALS_DIRECTORY"
+	PSKCredentialName       = "dtlspipe-psk"
 )
 
 type cipherlistArg struct {
@@ -127,28 +133,18 @@ func (r *ratelimitArg) Set(s string) error {
 var (
 	version = "undefined"
 
-	timeout         = flag.Duration("timeout", 10*time.Second, "network operation timeout")
-	idleTime        = flag.Duration("idle-time", 30*time.Second, "max idle time for UDP session")
-	pskHexOpt       = flag.String("psk", "", "hex-encoded pre-shared key. Can be generated with genpsk subcommand")
-	keyLength       = flag.Uint("key-length", 16, "generate key with specified length")
-	identity        = flag.String("identity", "", "client identity sent to server")
-	mtu             = flag.Int("mtu", 1400, "MTU used for DTLS fragments")
-	cpuprofile      = flag.String("cpuprofile", "", "write cpu profile to file")
-	skipHelloVerify = flag.Bool("skip-hello-verify", true, "(server only) skip hello verify request. Useful to workaround DPI")
-	connectionIDExt = flag.Bool("cid", true, "enable connection_id extension")
-	ciphersuites    = cipherlistArg{}
-	curves          = curvelistArg{}
-	staleMode       = util.EitherStale
-	timeLimit       = timelimitArg{}
-	rateLimit       = ratelimitArg{rlzone.Must(rlzone.NewSmallest[netip.Addr](1*time.Minute, 20))}
+	keyLength     = flag.Uint("key-length", 16, fmt.Sprintf("generate key with specified length in bytes, at most %d, the longest key accepted by -psk option", util.MaxPSKLength))
+	cpuprofile    = flag.String("cpuprofile", "", "write cpu profile to file")
+	metricsListen = flag.String("metrics-listen", "", "serve Prometheus metrics via HTTP on this `address` at /metrics path")
+	adminSocket   = flag.String("admin-socket", "", "serve admin HTTP API on unix socket at this `path`. API allows to list sessions with GET /sessions and terminate session with DELETE /sessions/{id}")
+	logFormat     = flag.String("log-format", "text", "log output `format`: text or json")
+	logLevel      = slog.LevelInfo
+	cliOpts       = newTunnelOptions()
 )
 
 func init() {
-	flag.Var(&ciphersuites, "ciphers", "colon-separated list of ciphers to use")
-	flag.Var(&curves, "curves", "colon-separated list of curves to use")
-	flag.Var(&staleMode, "stale-mode", "which stale side of connection makes whole session stale (both, either, left, right)")
-	flag.Var(&rateLimit, "rate-limit", "limit for incoming connections rate. Format: <limit>/<time duration> or empty string to disable")
-	flag.Var(&timeLimit, "time-limit", "limit for each session `duration`. Use single value X for fixed limit or range X-Y for randomized limit")
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimal `level` of logged messages: debug, info, warn or error")
+	cliOpts.register(flag.CommandLine)
 }
 
 func usage() {
@@ -158,6 +154,18 @@ func usage() {
 	fmt.Fprintf(out, "%s [OPTION]... server <BIND ADDRESS> <REMOTE ADDRESS>\n", ProgName)
 	fmt.Fprintln(out)
 	fmt.Fprintln(out, "  Run server listening on BIND ADDRESS for DTLS datagrams and forwarding decrypted UDP datagrams to REMOTE ADDRESS.")
+	fmt.Fprintln(out, "  If -routes option is specified, REMOTE ADDRESS is used only for client identities not found in routes file.")
+	fmt.Fprintln(out, "  Empty REMOTE ADDRESS rejects such clients.")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "  BIND ADDRESS may specify multiple addresses and ports. Server listens on each combination of them. BIND ADDRESS syntax is defined by following ABNF:")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "    BIND-ADDRESS = bind-addr *( \",\" bind-addr ) \":\" Port *( \",\" Port )")
+	fmt.Fprintln(out, "    bind-addr = IPv4address / \"[\" IPv6address \"]\"")
+	fmt.Fprintln(out, "    Port = port-number / port-number \"-\" port-number")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "  Server opens socket for each address, so BIND ADDRESS may expand to at most %d addresses.\n", server.MaxBindAddresses)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "  Example: '0.0.0.0:20000-20999' '0.0.0.0,[::]:443,20000-20100'")
 	fmt.Fprintln(out)
 	fmt.Fprintf(out, "%s [OPTION]... client <BIND ADDRESS> <REMOTE ADDRESS>\n", ProgName)
 	fmt.Fprintln(out)
@@ -186,9 +194,29 @@ func usage() {
 	fmt.Fprintln(out)
 	fmt.Fprintln(out, "  Example: 'example.org:20000-50000' '192.168.0.0/16,10.0.0.0/8,172.16.0.0-172.31.255.255:50000-60000'")
 	fmt.Fprintln(out)
-	fmt.Fprintf(out, "%s [OPTION]... genpsk\n", ProgName)
+	fmt.Fprintf(out, "%s [OPTION]... run <CONFIG FILE>\n", ProgName)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "  Run all tunnels declared in TOML CONFIG FILE in one process. Each tunnel is declared by")
+	fmt.Fprintln(out, "  table \"[name]\". Keys \"mode\" (server, client or hoppingclient), \"bind\" and \"remote\"")
+	fmt.Fprintln(out, "  correspond to command and its addresses. Key \"remote\" may be an array of strings for")
+	fmt.Fprintln(out, "  hoppingclient endpoint groups. Other keys are the same as command line options and default")
+	fmt.Fprintln(out, "  to values given on command line.")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s [OPTION]... genpsk [-from-passphrase]\n", ProgName)
 	fmt.Fprintln(out)
 	fmt.Fprintln(out, "  Generate and output PSK.")
+	fmt.Fprintln(out, "  With -from-passphrase, output PSK derived from passphrase and -identity option instead of random one.")
+	fmt.Fprintln(out, "  Passphrase is read from stdin unless -psk or -psk-file option is given. Result is the same key")
+	fmt.Fprintln(out, "  which is used with -psk-passphrase option.")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s genkey [-type ed25519|ecdsa]\n", ProgName)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "  Generate private key for -key option and output it in PEM format. Fingerprint of the key")
+	fmt.Fprintln(out, "  for -peer-keys and -pin-sha256 options of peers is printed to stderr.")
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "%s fingerprint <FILE>\n", ProgName)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "  Print fingerprint of public key from PEM-encoded private key, public key or certificate FILE.")
 	fmt.Fprintln(out)
 	fmt.Fprintf(out, "%s ciphers\n", ProgName)
 	fmt.Fprintln(out)
@@ -206,9 +234,18 @@ func usage() {
 	flag.PrintDefaults()
 }
 
-func cmdGenPSK() int {
-	if *keyLength > 64 {
-		fmt.Fprintln(os.Stderr, "key length is too big")
+func cmdGenPSK(args []string) int {
+	fs := flag.NewFlagSet("genpsk", flag.ContinueOnError)
+	fromPassphrase := fs.Bool("from-passphrase", false, "derive key from passphrase and -identity option")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *fromPassphrase {
+		return genPSKFromPassphrase()
+	}
+
+	if *keyLength > util.MaxPSKLength {
+		fmt.Fprintf(os.Stderr, "key length is too big, at most %d bytes are allowed\n", util.MaxPSKLength)
 		return 1
 	}
 	psk, err := util.GenPSKHex(int(*keyLength))
@@ -221,144 +258,178 @@ func cmdGenPSK() int {
 	return 0
 }
 
-func cmdVersion() int {
-	fmt.Println(version)
+func genPSKFromPassphrase() int {
+	opts := *cliOpts
+	if opts.pskHex == "" && opts.pskFile == "" {
+		opts.pskStdin = true
+		if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(os.Stderr, "Passphrase: ")
+		}
+	}
+	secret, err := opts.getSecret()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't get passphrase: %v\n", err)
+		return 1
+	}
+	defer clear(secret)
+	if len(secret) == 0 {
+		fmt.Fprintln(os.Stderr, "empty passphrase")
+		return 1
+	}
+	psk := keystore.DerivePSK(secret, []byte(opts.identity))
+	defer clear(psk)
+
+	fmt.Println(hex.EncodeToString(psk))
 	return 0
 }
 
-func cmdClient(bindAddress, remoteAddress string) int {
-	psk, err := simpleGetPSK()
-	if err != nil {
-		log.Printf("can't get PSK: %v", err)
+func cmdGenKey(args []string) int {
+	fs := flag.NewFlagSet("genkey", flag.ContinueOnError)
+	keyType := fs.String("type", "ed25519", "key type: ed25519 or ecdsa")
+	if err := fs.Parse(args); err != nil {
 		return 2
 	}
-	log.Printf("starting dtlspipe client: %s =[wrap into DTLS]=> %s", bindAddress, remoteAddress)
-	defer log.Println("dtlspipe client stopped")
-
-	appCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
-
-	cfg := client.Config{
-		BindAddress: bindAddress,
-		RemoteDialFunc: util.NewDynDialer(
-			addrgen.SingleEndpoint(remoteAddress).Endpoint,
-		).DialContext,
-		PSKCallback:    keystore.NewStaticKeystore(psk).PSKCallback,
-		PSKIdentity:    *identity,
-		Timeout:        *timeout,
-		IdleTimeout:    *idleTime,
-		BaseContext:    appCtx,
-		MTU:            *mtu,
-		CipherSuites:   ciphersuites.Value,
-		EllipticCurves: curves.Value,
-		StaleMode:      staleMode,
-		TimeLimitFunc:  util.TimeLimitFunc(timeLimit.low, timeLimit.high),
-		AllowFunc:      util.AllowByRatelimit(rateLimit.value),
-		EnableCID:      *connectionIDExt,
-	}
-
-	clt, err := client.New(&cfg)
+
+	key, err := util.GenerateKey(*keyType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "key generation error: %v\n", err)
+		return 1
+	}
+	keyPEM, err := util.MarshalPrivateKeyPEM(key)
 	if err != nil {
-		log.Fatalf("client startup failed: %v", err)
+		fmt.Fprintf(os.Stderr, "key generation error: %v\n", err)
+		return 1
+	}
+	fingerprint, err := util.KeyFingerprint(key.Public())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "key generation error: %v\n", err)
+		return 1
 	}
-	defer clt.Close()
-
-	<-appCtx.Done()
 
+	os.Stdout.Write(keyPEM)
+	fmt.Fprintf(os.Stderr, "fingerprint: %s\n", fingerprint)
 	return 0
 }
 
-func cmdHoppingClient(args []string) int {
-	bindAddress := args[0]
-	args = args[1:]
-	psk, err := simpleGetPSK()
+func cmdFingerprint(filename string) int {
+	pub, err := util.LoadPublicKey(filename)
 	if err != nil {
-		log.Printf("can't get PSK: %v", err)
-		return 2
+		fmt.Fprintf(os.Stderr, "can't load key: %v\n", err)
+		return 1
 	}
-	log.Printf("starting dtlspipe client: %s =[wrap into DTLS]=> %v", bindAddress, args)
-	defer log.Println("dtlspipe client stopped")
-
-	appCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
-
-	gen, err := addrgen.EqualMultiEndpointGenFromSpecs(args)
+	fingerprint, err := util.KeyFingerprint(pub)
 	if err != nil {
-		log.Printf("can't construct generator: %v", err)
-		return 2
+		fmt.Fprintf(os.Stderr, "can't compute fingerprint: %v\n", err)
+		return 1
 	}
+	fmt.Println(fingerprint)
+	return 0
+}
 
-	cfg := client.Config{
-		BindAddress: bindAddress,
-		RemoteDialFunc: util.NewDynDialer(
-			func() string {
-				ep := gen.Endpoint()
-				log.Printf("selected new endpoint %s", ep)
-				return ep
-			},
-		).DialContext,
-		PSKCallback:    keystore.NewStaticKeystore(psk).PSKCallback,
-		PSKIdentity:    *identity,
-		Timeout:        *timeout,
-		IdleTimeout:    *idleTime,
-		BaseContext:    appCtx,
-		MTU:            *mtu,
-		CipherSuites:   ciphersuites.Value,
-		EllipticCurves: curves.Value,
-		StaleMode:      staleMode,
-		TimeLimitFunc:  util.TimeLimitFunc(timeLimit.low, timeLimit.high),
-		AllowFunc:      util.AllowByRatelimit(rateLimit.value),
-		EnableCID:      *connectionIDExt,
-	}
-
-	clt, err := client.New(&cfg)
-	if err != nil {
-		log.Fatalf("client startup failed: %v", err)
-	}
-	defer clt.Close()
+func cmdVersion() int {
+	fmt.Println(version)
+	return 0
+}
 
-	<-appCtx.Done()
+func cmdClient(bindAddress, remoteAddress string) int {
+	return runTunnels([]*tunnel{{
+		mode:    modeClient,
+		bind:    bindAddress,
+		remotes: []string{remoteAddress},
+		opts:    cliOpts,
+	}})
+}
 
-	return 0
+func cmdHoppingClient(args []string) int {
+	return runTunnels([]*tunnel{{
+		mode:    modeHoppingClient,
+		bind:    args[0],
+		remotes: args[1:],
+		opts:    cliOpts,
+	}})
 }
 
 func cmdServer(bindAddress, remoteAddress string) int {
-	psk, err := simpleGetPSK()
+	return runTunnels([]*tunnel{{
+		mode:    modeServer,
+		bind:    bindAddress,
+		remotes: []string{remoteAddress},
+		opts:    cliOpts,
+	}})
+}
+
+func cmdRun(filename string) int {
+	tunnels, err := loadTunnelsFile(filename, cliOpts)
 	if err != nil {
-		log.Printf("can't get PSK: %v", err)
+		slog.Error("can't load config", util.ErrorAttrs(err)...)
 		return 2
 	}
-	log.Printf("starting dtlspipe server: %s =[unwrap from DTLS]=> %s", bindAddress, remoteAddress)
-	defer log.Println("dtlspipe server stopped")
-
-	appCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer cancel()
-
-	cfg := server.Config{
-		BindAddress:     bindAddress,
-		RemoteAddress:   remoteAddress,
-		PSKCallback:     keystore.NewStaticKeystore(psk).PSKCallback,
-		Timeout:         *timeout,
-		IdleTimeout:     *idleTime,
-		BaseContext:     appCtx,
-		MTU:             *mtu,
-		SkipHelloVerify: *skipHelloVerify,
-		CipherSuites:    ciphersuites.Value,
-		EllipticCurves:  curves.Value,
-		StaleMode:       staleMode,
-		TimeLimitFunc:   util.TimeLimitFunc(timeLimit.low, timeLimit.high),
-		AllowFunc:       util.AllowByRatelimit(rateLimit.value),
-		EnableCID:       *connectionIDExt,
-	}
-
-	srv, err := server.New(&cfg)
+	return runTunnels(tunnels)
+}
+
+func startMetricsServer() (func(), error) {
+	if *metricsListen == "" {
+		return func() {}, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	listener, err := net.Listen("tcp", *metricsListen)
 	if err != nil {
-		log.Fatalf("server startup failed: %v", err)
+		return nil, err
 	}
-	defer srv.Close()
+	slog.Info("serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+	return serveHTTP(listener, mux), nil
+}
 
-	<-appCtx.Done()
-	return 0
+func startAdminServer(sessions *session.Registry) (func(), error) {
+	if *adminSocket == "" {
+		return func() {}, nil
+	}
+	if fi, err := os.Stat(*adminSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(*adminSocket)
+	}
+	listener, err := net.Listen("unix", *adminSocket)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("serving admin API", "socket", *adminSocket)
+	return serveHTTP(listener, admin.NewHandler(sessions)), nil
+}
+
+func serveHTTP(listener net.Listener, handler http.Handler) func() {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cliOpts.timeout,
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", append([]any{"listen_address", listener.Addr().String()}, util.ErrorAttrs(err)...)...)
+		}
+	}()
+	return func() {
+		srv.Close()
+	}
+}
+
+func handleReload(ctx context.Context, reload func() error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				slog.Info("reloading configuration")
+				if err := reload(); err != nil {
+					slog.Error("configuration reload failed", util.ErrorAttrs(err)...)
+				} else {
+					slog.Info("configuration reloaded")
+				}
+			}
+		}
+	}()
 }
 
 func cmdCiphers() int {
@@ -380,23 +451,38 @@ func run() int {
 	flag.Parse()
 	args := flag.Args()
 
+	logHandler, err := newLogHandler()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't configure logging: %v\n", err)
+		return 2
+	}
+	slog.SetDefault(slog.New(logHandler))
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			slog.Error("can't create cpu profile", util.ErrorAttrs(err)...)
+			return 2
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
 
+	if len(args) > 0 {
+		switch args[0] {
+		case "genpsk":
+			return cmdGenPSK(args[1:])
+		case "genkey":
+			return cmdGenKey(args[1:])
+		}
+	}
+
 	switch len(args) {
 	case 0:
 		usage()
 		return 2
 	case 1:
 		switch args[0] {
-		case "genpsk":
-			return cmdGenPSK()
 		case "ciphers":
 			return cmdCiphers()
 		case "curves":
@@ -405,6 +491,12 @@ func run() int {
 			return cmdVersion()
 		}
 	case 2:
+		switch args[0] {
+		case "run":
+			return cmdRun(args[1])
+		case "fingerprint":
+			return cmdFingerprint(args[1])
+		}
 		usage()
 		return 2
 	case 3:
@@ -424,25 +516,18 @@ func run() int {
 }
 
 func main() {
-	log.Default().SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-	log.Default().SetPrefix(strings.ToUpper(ProgName) + ": ")
 	os.Exit(run())
 }
 
-func simpleGetPSK() ([]byte, error) {
-	pskHex := os.Getenv(PSKEnvVarKey)
-	if pskHex == "" {
-		os.Unsetenv(PSKEnvVarKey)
-	}
-	if *pskHexOpt != "" {
-		pskHex = *pskHexOpt
+func newLogHandler() (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
 	}
-	if pskHex == "" {
-		return nil, fmt.Errorf("no PSK command line option provided and neither %s environment variable is set", PSKEnvVarKey)
-	}
-	psk, err := util.PSKFromHex(pskHex)
-	if err != nil {
-		return nil, fmt.Errorf("can't hex-decode PSK: %w", err)
+	switch *logFormat {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, opts), nil
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, opts), nil
 	}
-	return psk, nil
+	return nil, fmt.Errorf("unknown log format %q", *logFormat)
 }
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/SenseUnit/dtlspipe/addrgen"
+	"github.com/SenseUnit/dtlspipe/chaff"
+	"github.com/SenseUnit/dtlspipe/client"
+	"github.com/SenseUnit/dtlspipe/hsprofile"
+	"github.com/SenseUnit/dtlspipe/keystore"
+	"github.com/SenseUnit/dtlspipe/knock"
+	"github.com/SenseUnit/dtlspipe/padding"
+	"github.com/SenseUnit/dtlspipe/resumption"
+	"github.com/SenseUnit/dtlspipe/server"
+	"github.com/SenseUnit/dtlspipe/session"
+	"github.com/SenseUnit/dtlspipe/util"
+	"github.com/Snawoot/rlzone"
+)
+
+const (
+	modeServer        = "server"
+	modeClient        = "client"
+	modeHoppingClient = "hoppingclient"
+)
+
+// tunnelOptions holds options which may differ between tunnels running
+// in one process.
+type tunnelOptions struct {
+	timeout         time.Duration
+	idleTime        time.Duration
+	pskHex          string
+	pskFile         string
+	pskStdin        bool
+	pskPassphrase   bool
+	identity        string
+	mtu             int
+	skipHelloVerify bool
+	connectionIDExt bool
+	optionsFile     string
+	routesFile      string
+	rotationLead    time.Duration
+	multiplex       int
+	keepalive       time.Duration
+	padding         string
+	chaff           string
+	chaffBudget     int
+	hsProfile       string
+	acceptProfiles  bool
+	knock           bool
+	knockPorts      string
+	knockTTL        time.Duration
+	affinity        bool
+	upstreamGrace   time.Duration
+	warmPool        int
+	warmPoolTTL     time.Duration
+	resumption      bool
+	resumptionTTL   time.Duration
+	resumptionSize  int
+	resumptionFile  string
+	proxyIdentity   bool
+	keystoreSpec    string
+	keystoreTimeout time.Duration
+	keystoreTTL     time.Duration
+	certFile        string
+	keyFile         string
+	caFile          string
+	serverName      string
+	pinSHA256       string
+	peerKeysFile    string
+	ciphersuites    cipherlistArg
+	curves          curvelistArg
+	staleMode       util.StaleMode
+	timeLimit       timelimitArg
+	hopInterval     timelimitArg
+	proxyProtocol   server.ProxyProtocolMode
+	rateLimit       ratelimitArg
+}
+
+func newTunnelOptions() *tunnelOptions {
+	return &tunnelOptions{
+		timeout:         10 * time.Second,
+		idleTime:        30 * time.Second,
+		mtu:             1400,
+		skipHelloVerify: true,
+		connectionIDExt: true,
+		upstreamGrace:   30 * time.Second,
+		chaffBudget:     chaff.DefaultBudget,
+		knockTTL:        knock.DefaultTTL,
+		resumptionTTL:   1 * time.Hour,
+		resumptionSize:  1024,
+		keystoreTimeout: 5 * time.Second,
+		keystoreTTL:     5 * time.Minute,
+		staleMode:       util.EitherStale,
+		proxyProtocol:   server.ProxyProtocolOff,
+		rateLimit:       ratelimitArg{rlzone.Must(rlzone.NewSmallest[netip.Addr](1*time.Minute, 20))},
+	}
+}
+
+// register defines flags for options on fs. Current option values are
+// used as defaults.
+func (o *tunnelOptions) register(fs *flag.FlagSet) {
+	fs.DurationVar(&o.timeout, "timeout", o.timeout, "network operation timeout")
+	fs.DurationVar(&o.idleTime, "idle-time", o.idleTime, "max idle time for UDP session")
+	fs.StringVar(&o.pskHex, "psk", o.pskHex, "hex-encoded pre-shared key. Can be generated with genpsk subcommand")
+	fs.StringVar(&o.pskFile, "psk-file", o.pskFile, "read hex-encoded pre-shared key from the first line of `file`")
+	fs.BoolVar(&o.pskStdin, "psk-stdin", o.pskStdin, "read hex-encoded pre-shared key from the first line of stdin")
+	fs.BoolVar(&o.pskPassphrase, "psk-passphrase", o.pskPassphrase, "treat value of -psk, -psk-file or -psk-stdin option, environment variable or credential as passphrase and derive key from it and identity")
+	fs.StringVar(&o.identity, "identity", o.identity, "client identity sent to server")
+	fs.IntVar(&o.mtu, "mtu", o.mtu, "MTU used for DTLS fragments")
+	fs.BoolVar(&o.skipHelloVerify, "skip-hello-verify", o.skipHelloVerify, "(server only) skip hello verify request. Useful to workaround DPI")
+	fs.BoolVar(&o.connectionIDExt, "cid", o.connectionIDExt, "enable connection_id extension")
+	fs.StringVar(&o.optionsFile, "options-file", o.optionsFile, "TOML `file` with reloadable options (ciphers, idle-time, rate-limit, time-limit). Options from file override command line options. File is read again along with keystore on SIGHUP")
+	fs.StringVar(&o.routesFile, "routes", o.routesFile, "(server only) `file` with identity and upstream address pairs. Sessions with identities not listed in file are forwarded to REMOTE ADDRESS. File is read again on SIGHUP")
+	fs.DurationVar(&o.rotationLead, "rotation-lead", o.rotationLead, "(client only) establish replacement DTLS connection this long before session time limit expires and seamlessly switch session to it. Zero value disables rotation")
+	fs.IntVar(&o.multiplex, "mux", o.multiplex, "(client only) carry all sessions as flows of this number of multiplexed DTLS connections instead of separate DTLS connection for each session. Zero value disables multiplexing")
+	fs.DurationVar(&o.keepalive, "keepalive", o.keepalive, "(client only) send keepalive inside DTLS connection after this `duration` without outgoing datagrams, so NAT bindings are not dropped. Server discards keepalives. Requires server with keepalive support. Zero value disables keepalives")
+	fs.StringVar(&o.padding, "padding", o.padding, "pad datagrams inside DTLS connection to sizes chosen by distribution `spec`: uniform[:<max padding>], exp:<mean padding>, bucket:<size>,<size>,... or max. Padded size is limited by -mtu. For client it enables padding. For server it specifies distribution for connections of clients with padding enabled, uniform by default")
+	fs.StringVar(&o.chaff, "chaff", o.chaff, "send dummy datagrams inside idle DTLS connections on schedule `spec`: poisson:<rate> or fixed:<rate>, where rate is number of datagrams per second. Other side discards them. For client it enables chaff. For server it enables sending chaff on connections of clients with chaff enabled")
+	fs.IntVar(&o.chaffBudget, "chaff-budget", o.chaffBudget, "limit of bandwidth spent on chaff by all connections in bytes per second")
+	fs.StringVar(&o.hsProfile, "handshake-profile", o.hsProfile, "(client only) shape DTLS ClientHello like handshake of WebRTC stack `name`: "+strings.Join(hsprofile.Names(), ", ")+". Curves restricted by -curves option are kept, which makes ClientHello differ from browser one. Requires server with -accept-handshake-profiles option")
+	fs.BoolVar(&o.acceptProfiles, "accept-handshake-profiles", o.acceptProfiles, "(server only) accept clients with handshake profiles")
+	fs.BoolVar(&o.knock, "knock", o.knock, "send knock datagram authenticated with pre-shared key before each handshake. For server it makes server ignore source addresses which didn't knock. Requires PSK authentication")
+	fs.StringVar(&o.knockPorts, "knock-ports", o.knockPorts, "comma-separated `list` of ports for knock sequence sent before each handshake (and before knock datagram if -knock is enabled). For server it makes server listen these ports and ignore source addresses which didn't knock")
+	fs.DurationVar(&o.knockTTL, "knock-ttl", o.knockTTL, "(server only) allow handshakes from source address for this `duration` after knock")
+	fs.BoolVar(&o.affinity, "upstream-affinity", o.affinity, "(client only) send session token, so server attaches reconnecting session to the same upstream socket. Requires server with upstream affinity support")
+	fs.DurationVar(&o.upstreamGrace, "upstream-grace", o.upstreamGrace, "(server only) keep upstream socket of session with session token for this `duration` after session end, so reconnecting client is attached to it. Zero value disables upstream affinity")
+	fs.IntVar(&o.warmPool, "warm-pool", o.warmPool, "(client only) number of DTLS connections established in advance, so new sessions don't wait for handshake. Zero value disables pool")
+	fs.DurationVar(&o.warmPoolTTL, "warm-pool-ttl", o.warmPoolTTL, "(client only) replace unclaimed warm pool connections after this `duration`. Should be less than server idle time. Zero value means half of -idle-time")
+	fs.BoolVar(&o.resumption, "resumption", o.resumption, "enable DTLS session resumption, so reconnecting client skips full handshake")
+	fs.DurationVar(&o.resumptionTTL, "resumption-ttl", o.resumptionTTL, "how long DTLS sessions are kept for resumption")
+	fs.IntVar(&o.resumptionSize, "resumption-cache-size", o.resumptionSize, "max number of DTLS sessions kept for resumption")
+	fs.StringVar(&o.resumptionFile, "resumption-file", o.resumptionFile, "(client only) `file` to keep DTLS sessions for resumption across restarts")
+	fs.BoolVar(&o.proxyIdentity, "proxy-protocol-identity", o.proxyIdentity, "(server only) include client PSK identity into PROXY protocol header as TLV of type 0xE0")
+	fs.StringVar(&o.keystoreSpec, "keystore", o.keystoreSpec, "keystore `spec`. Use empty value for single key from -psk, -psk-file or -psk-stdin option, \"file:<path>\" for file with identity and hex-encoded key pairs or \"exec:<command> [args]...\" for helper program which receives identity in DTLSPIPE_IDENTITY environment variable and outputs hex-encoded key")
+	fs.DurationVar(&o.keystoreTimeout, "keystore-timeout", o.keystoreTimeout, "time limit for exec keystore helper program run")
+	fs.DurationVar(&o.keystoreTTL, "keystore-cache-ttl", o.keystoreTTL, "time to cache keys returned by exec keystore helper program. Failures are cached for at most 5s. Zero value disables caching")
+	fs.StringVar(&o.certFile, "cert", o.certFile, "PEM-encoded certificate chain `file`. Enables certificate authentication instead of PSK. Server certificate for server, optional client certificate for client")
+	fs.StringVar(&o.keyFile, "key", o.keyFile, "PEM-encoded private key `file` for -cert certificate. Without -cert the key is wrapped into self-signed certificate, enabling certificate authentication with verification by key fingerprint. Server with such key requires -peer-keys or -ca option. Keys can be generated with genkey subcommand")
+	fs.StringVar(&o.caFile, "ca", o.caFile, "PEM-encoded CA certificates `file`. Server requires client certificate issued by these CAs, client verifies server certificate with them instead of system CAs. Enables certificate authentication for client")
+	fs.StringVar(&o.serverName, "server-name", o.serverName, "(client only) `name` expected in server certificate. Enables certificate authentication")
+	fs.StringVar(&o.pinSHA256, "pin-sha256", o.pinSHA256, "(client only) comma-separated `list` of base64-encoded SHA-256 hashes of accepted server public keys. Server certificate chain is not verified unless -ca is specified. Enables certificate authentication")
+	fs.StringVar(&o.peerKeysFile, "peer-keys", o.peerKeysFile, "`file` with fingerprints of accepted peer public keys, one per line, optionally followed by identity assigned to peer. Server requires client to present one of these keys, client accepts server with one of these keys. File is read again on SIGHUP. Enables certificate authentication")
+	fs.Var(&o.ciphersuites, "ciphers", "colon-separated list of ciphers to use")
+	fs.Var(&o.curves, "curves", "colon-separated list of curves to use")
+	fs.Var(&o.staleMode, "stale-mode", "which stale side of connection makes whole session stale (both, either, left, right)")
+	fs.Var(&o.rateLimit, "rate-limit", "limit for incoming connections rate. Format: <limit>/<time duration> or empty string to disable")
+	fs.Var(&o.timeLimit, "time-limit", "limit for each session `duration`. Use single value X for fixed limit or range X-Y for randomized limit")
+	fs.Var(&o.proxyProtocol, "proxy-protocol", "(server only) send PROXY protocol v2 header with client address to upstream: off, first (as a separate first datagram of session) or each (prepended to every datagram)")
+	fs.Var(&o.hopInterval, "hop-interval", "(client only) move established sessions to a new endpoint every `duration`. Use single value X for fixed interval or range X-Y for randomized interval. Requires -cid. Zero value disables hopping")
+}
+
+func (o *tunnelOptions) hopIntervalFunc() func() time.Duration {
+	if o.hopInterval.low == 0 && o.hopInterval.high == 0 {
+		return nil
+	}
+	return util.TimeLimitFunc(o.hopInterval.low, o.hopInterval.high)
+}
+
+type reloadableOptions struct {
+	idleTime     time.Duration
+	ciphersuites cipherlistArg
+	timeLimit    timelimitArg
+	rateLimit    ratelimitArg
+}
+
+func (o *tunnelOptions) loadOptions() (*reloadableOptions, error) {
+	opts := &reloadableOptions{
+		idleTime:     o.idleTime,
+		ciphersuites: o.ciphersuites,
+		timeLimit:    o.timeLimit,
+		rateLimit:    o.rateLimit,
+	}
+	if o.optionsFile == "" {
+		return opts, nil
+	}
+
+	var table map[string]any
+	if _, err := toml.DecodeFile(o.optionsFile, &table); err != nil {
+		return nil, fmt.Errorf("can't read options file %q: %w", o.optionsFile, err)
+	}
+
+	fs := flag.NewFlagSet("options file", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.DurationVar(&opts.idleTime, "idle-time", opts.idleTime, "")
+	fs.Var(&opts.ciphersuites, "ciphers", "")
+	fs.Var(&opts.timeLimit, "time-limit", "")
+	fs.Var(&opts.rateLimit, "rate-limit", "")
+	if err := setFlags(fs, table); err != nil {
+		return nil, fmt.Errorf("can't parse options file %q: %w", o.optionsFile, err)
+	}
+	return opts, nil
+}
+
+// getSecret returns hex-encoded PSK or passphrase from -psk, -psk-file
+// or -psk-stdin option, environment variable or systemd credential, in
+// that order. Caller should zero returned secret after use.
+func (o *tunnelOptions) getSecret() ([]byte, error) {
+	explicit := 0
+	for _, set := range []bool{o.pskHex != "", o.pskFile != "", o.pskStdin} {
+		if set {
+			explicit++
+		}
+	}
+	if explicit > 1 {
+		return nil, errors.New("only one of -psk, -psk-file and -psk-stdin options can be specified")
+	}
+	switch {
+	case o.pskHex != "":
+		return []byte(o.pskHex), nil
+	case o.pskFile != "":
+		return util.ReadSecretFile(o.pskFile)
+	case o.pskStdin:
+		return readStdinSecret()
+	}
+
+	if pskHex := os.Getenv(PSKEnvVarKey); pskHex != "" {
+		return []byte(pskHex), nil
+	}
+	os.Unsetenv(PSKEnvVarKey)
+
+	if credsDir := os.Getenv(CredentialsDirEnvVarKey); credsDir != "" {
+		credPath := filepath.Join(credsDir, PSKCredentialName)
+		if _, err := os.Stat(credPath); err == nil {
+			return util.ReadSecretFile(credPath)
+		}
+	}
+	return nil, fmt.Errorf("no PSK option provided, %s environment variable is not set and %q credential is not found", PSKEnvVarKey, PSKCredentialName)
+}
+
+var (
+	stdinSecretOnce sync.Once
+	stdinSecret     []byte
+	stdinSecretErr  error
+)
+
+// readStdinSecret returns secret read from stdin. Stdin is read only
+// once and the secret is retained for configuration reloads and other
+// tunnels.
+func readStdinSecret() ([]byte, error) {
+	stdinSecretOnce.Do(func() {
+		stdinSecret, stdinSecretErr = util.ReadSecret(os.Stdin)
+	})
+	return bytes.Clone(stdinSecret), stdinSecretErr
+}
+
+func (o *tunnelOptions) getKeystore() (keystore.Keystore, error) {
+	switch {
+	case o.keystoreSpec == "":
+		secret, err := o.getSecret()
+		if err != nil {
+			return nil, fmt.Errorf("can't get PSK: %w", err)
+		}
+		defer clear(secret)
+		if o.pskPassphrase {
+			if len(secret) == 0 {
+				return nil, errors.New("empty passphrase")
+			}
+			return keystore.NewPassphraseKeystore(secret), nil
+		}
+		psk, err := util.DecodePSKHex(secret)
+		if err != nil {
+			return nil, fmt.Errorf("can't get PSK: %w", err)
+		}
+		defer clear(psk)
+		return keystore.NewStaticKeystore(psk), nil
+	case strings.HasPrefix(o.keystoreSpec, "file:"):
+		return keystore.NewFileKeystore(strings.TrimPrefix(o.keystoreSpec, "file:"))
+	case strings.HasPrefix(o.keystoreSpec, "exec:"):
+		return keystore.NewExecKeystore(strings.Fields(strings.TrimPrefix(o.keystoreSpec, "exec:")), o.keystoreTimeout, o.keystoreTTL)
+	}
+	return nil, fmt.Errorf("unknown keystore spec %q", o.keystoreSpec)
+}
+
+// certMode reports whether tunnel of given mode uses certificate
+// authentication instead of PSK.
+func (o *tunnelOptions) certMode(mode string) bool {
+	if mode == modeServer {
+		return o.certFile != "" || o.keyFile != ""
+	}
+	return o.certFile != "" || o.keyFile != "" || o.caFile != "" || o.serverName != "" || o.pinSHA256 != "" || o.peerKeysFile != ""
+}
+
+// parsePortList parses comma-separated list of ports, such as value of
+// -knock-ports option. Empty list yields no ports.
+func parsePortList(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var ports []uint16
+	for _, field := range strings.Split(list, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("bad port %q", field)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+type certAuth struct {
+	certificates []tls.Certificate
+	cas          *x509.CertPool
+	pins         [][]byte
+	peerKeys     map[string]string
+}
+
+func (o *tunnelOptions) loadCertAuth() (*certAuth, error) {
+	auth := new(certAuth)
+	switch {
+	case o.certFile != "" && o.keyFile == "":
+		return nil, errors.New("-cert option requires -key option")
+	case o.certFile != "":
+		cert, err := util.LoadCertificate(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.certificates = []tls.Certificate{cert}
+	case o.keyFile != "":
+		key, err := util.LoadPrivateKey(o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := util.SelfSignedCertificate(key, o.identity)
+		if err != nil {
+			return nil, err
+		}
+		auth.certificates = []tls.Certificate{cert}
+	}
+	if o.caFile != "" {
+		cas, err := util.LoadCertPool(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.cas = cas
+	}
+	pins, err := util.ParseSPKIPins(o.pinSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("bad -pin-sha256 option: %w", err)
+	}
+	auth.pins = pins
+	if o.peerKeysFile != "" {
+		peerKeys, err := util.LoadPeerKeysFile(o.peerKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.peerKeys = peerKeys
+		for fp := range peerKeys {
+			auth.pins = append(auth.pins, []byte(fp))
+		}
+	}
+	return auth, nil
+}
+
+func (o *tunnelOptions) loadRoutes() (map[string]string, error) {
+	if o.routesFile == "" {
+		return nil, nil
+	}
+	return server.LoadRoutesFile(o.routesFile)
+}
+
+// tunnel is a single client or server instance along with its options.
+type tunnel struct {
+	name    string
+	mode    string
+	bind    string
+	remotes []string
+	opts    *tunnelOptions
+
+	logger    *slog.Logger
+	sessCache *resumption.Cache
+	clientCfg *client.Config
+	serverCfg *server.Config
+}
+
+// prepare validates tunnel and loads everything required to start it.
+func (t *tunnel) prepare() error {
+	t.logger = slog.Default()
+	if t.name != "" {
+		t.logger = t.logger.With(slog.String("tunnel", t.name))
+	}
+
+	switch t.mode {
+	case modeServer, modeClient:
+		if len(t.remotes) != 1 {
+			return fmt.Errorf("%s requires exactly one remote address", t.mode)
+		}
+	case modeHoppingClient:
+		if len(t.remotes) == 0 {
+			return errors.New("hoppingclient requires at least one endpoint group")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", t.mode)
+	}
+
+	opts, err := t.opts.loadOptions()
+	if err != nil {
+		return fmt.Errorf("can't load options: %w", err)
+	}
+
+	if t.opts.resumption {
+		if t.opts.resumptionTTL <= 0 || t.opts.resumptionSize <= 0 {
+			return errors.New("session resumption requires positive TTL and cache size")
+		}
+		if t.mode == modeServer {
+			if t.opts.resumptionFile != "" {
+				return errors.New("-resumption-file option is not supported for server")
+			}
+			t.sessCache = resumption.NewCache("server", t.opts.resumptionTTL, t.opts.resumptionSize)
+		} else if t.opts.resumptionFile != "" {
+			t.sessCache, err = resumption.NewFileCache("client", t.opts.resumptionFile, t.opts.resumptionTTL, t.opts.resumptionSize, t.logger)
+			if err != nil {
+				return err
+			}
+		} else {
+			t.sessCache = resumption.NewCache("client", t.opts.resumptionTTL, t.opts.resumptionSize)
+		}
+	}
+
+	var paddingDist padding.Distribution
+	if t.opts.padding != "" {
+		paddingDist, err = padding.ParseDistribution(t.opts.padding)
+		if err != nil {
+			return fmt.Errorf("can't parse padding spec: %w", err)
+		}
+	}
+
+	var chaffSchedule chaff.Schedule
+	if t.opts.chaff != "" {
+		chaffSchedule, err = chaff.ParseSchedule(t.opts.chaff)
+		if err != nil {
+			return fmt.Errorf("can't parse chaff spec: %w", err)
+		}
+	}
+	if t.opts.chaffBudget <= 0 {
+		return errors.New("chaff budget should be positive")
+	}
+
+	if t.opts.knock && t.opts.certMode(t.mode) {
+		return errors.New("-knock option requires PSK authentication")
+	}
+	knockPorts, err := parsePortList(t.opts.knockPorts)
+	if err != nil {
+		return fmt.Errorf("can't parse knock ports: %w", err)
+	}
+
+	if t.mode == modeServer {
+		if (t.opts.caFile != "" || t.opts.peerKeysFile != "") && !t.opts.certMode(t.mode) {
+			return errors.New("-ca and -peer-keys options require -key option for server")
+		}
+		if t.opts.keyFile != "" && t.opts.certFile == "" && t.opts.caFile == "" && t.opts.peerKeysFile == "" {
+			// otherwise server would accept any client
+			return errors.New("-key option without -cert requires -peer-keys or -ca option for server")
+		}
+		if _, err := server.ParseBindSpec(t.bind); err != nil {
+			return fmt.Errorf("can't parse bind address: %w", err)
+		}
+		routes, err := t.opts.loadRoutes()
+		if err != nil {
+			return fmt.Errorf("can't load routes: %w", err)
+		}
+		t.serverCfg = &server.Config{
+			BindAddress:     t.bind,
+			RemoteAddress:   t.remotes[0],
+			Routes:          routes,
+			Timeout:         t.opts.timeout,
+			IdleTimeout:     opts.idleTime,
+			MTU:             t.opts.mtu,
+			SkipHelloVerify: t.opts.skipHelloVerify,
+			CipherSuites:    opts.ciphersuites.Value,
+			EllipticCurves:  t.opts.curves.Value,
+			StaleMode:       t.opts.staleMode,
+			TimeLimitFunc:   util.TimeLimitFunc(opts.timeLimit.low, opts.timeLimit.high),
+			AllowFunc:       util.AllowByRatelimit(opts.rateLimit.value),
+			EnableCID:       t.opts.connectionIDExt,
+			ProxyProtocol:   t.opts.proxyProtocol,
+			ProxyIdentity:   t.opts.proxyIdentity,
+			SessionCache:    t.sessCache,
+			UpstreamGrace:   t.opts.upstreamGrace,
+			Padding:         paddingDist,
+			Chaff:           chaffSchedule,
+			ChaffBudget:     t.opts.chaffBudget,
+			AcceptProfiles:  t.opts.acceptProfiles,
+			Knock:           t.opts.knock,
+			KnockPorts:      knockPorts,
+			KnockTTL:        t.opts.knockTTL,
+			Logger:          t.logger,
+		}
+		return t.setServerAuth(t.serverCfg)
+	}
+
+	if _, err := netip.ParseAddrPort(t.bind); err != nil {
+		return fmt.Errorf("can't parse bind address: %w", err)
+	}
+	if t.opts.hopIntervalFunc() != nil && !t.opts.connectionIDExt {
+		return errors.New("endpoint hopping requires connection_id extension to be enabled")
+	}
+	if t.opts.multiplex < 0 || t.opts.warmPool < 0 {
+		return errors.New("number of connections can't be negative")
+	}
+	if t.opts.multiplex > 0 && t.opts.warmPool > 0 {
+		return errors.New("warm pool is not supported with multiplexing")
+	}
+	if t.opts.multiplex > 0 && t.opts.rotationLead > 0 {
+		return errors.New("session rotation is not supported with multiplexing")
+	}
+	if t.opts.multiplex > 0 && t.opts.affinity {
+		return errors.New("upstream affinity is not supported with multiplexing")
+	}
+	var profile *hsprofile.Profile
+	if t.opts.hsProfile != "" {
+		profile, err = hsprofile.Get(t.opts.hsProfile)
+		if err != nil {
+			return err
+		}
+	}
+	endpointFunc := addrgen.SingleEndpoint(t.remotes[0]).Endpoint
+	if t.mode == modeHoppingClient {
+		gen, err := addrgen.EqualMultiEndpointGenFromSpecs(t.remotes)
+		if err != nil {
+			return fmt.Errorf("can't construct generator: %w", err)
+		}
+		endpointFunc = func() string {
+			ep := gen.Endpoint()
+			t.logger.Debug("selected new endpoint", util.LogKeyEndpoint, ep)
+			return ep
+		}
+	}
+	t.clientCfg = &client.Config{
+		BindAddress:      t.bind,
+		RemoteDialFunc:   util.NewDynDialer(endpointFunc).DialContext,
+		Timeout:          t.opts.timeout,
+		IdleTimeout:      opts.idleTime,
+		MTU:              t.opts.mtu,
+		CipherSuites:     opts.ciphersuites.Value,
+		EllipticCurves:   t.opts.curves.Value,
+		StaleMode:        t.opts.staleMode,
+		TimeLimitFunc:    util.TimeLimitFunc(opts.timeLimit.low, opts.timeLimit.high),
+		AllowFunc:        util.AllowByRatelimit(opts.rateLimit.value),
+		RotationLeadTime: t.opts.rotationLead,
+		HopIntervalFunc:  t.opts.hopIntervalFunc(),
+		Keepalive:        t.opts.keepalive,
+		EnableCID:        t.opts.connectionIDExt,
+		UpstreamAffinity: t.opts.affinity,
+		Multiplex:        t.opts.multiplex,
+		Padding:          paddingDist,
+		Chaff:            chaffSchedule,
+		ChaffBudget:      t.opts.chaffBudget,
+		HandshakeProfile: profile,
+		Knock:            t.opts.knock,
+		KnockPorts:       knockPorts,
+		WarmPoolSize:     t.opts.warmPool,
+		WarmPoolTTL:      t.opts.warmPoolTTL,
+		Logger:           t.logger,
+	}
+	if t.sessCache != nil {
+		t.clientCfg.SessionStore = t.sessCache
+	}
+	return t.setClientAuth(t.clientCfg)
+}
+
+// setServerAuth loads keystore or certificates into cfg.
+func (t *tunnel) setServerAuth(cfg *server.Config) error {
+	if !t.opts.certMode(t.mode) {
+		ks, err := t.opts.getKeystore()
+		if err != nil {
+			return fmt.Errorf("can't get keystore: %w", err)
+		}
+		cfg.PSKCallback = ks.PSKCallback
+		return nil
+	}
+	auth, err := t.opts.loadCertAuth()
+	if err != nil {
+		return fmt.Errorf("can't load certificates: %w", err)
+	}
+	cfg.Certificates = auth.certificates
+	cfg.ClientCAs = auth.cas
+	cfg.PeerKeys = auth.peerKeys
+	return nil
+}
+
+// setClientAuth loads keystore or certificates into cfg.
+func (t *tunnel) setClientAuth(cfg *client.Config) error {
+	if !t.opts.certMode(t.mode) {
+		ks, err := t.opts.getKeystore()
+		if err != nil {
+			return fmt.Errorf("can't get keystore: %w", err)
+		}
+		cfg.PSKCallback = keystore.IdentityPSKCallback(ks, t.opts.identity)
+		cfg.PSKIdentity = t.opts.identity
+		return nil
+	}
+	auth, err := t.opts.loadCertAuth()
+	if err != nil {
+		return fmt.Errorf("can't load certificates: %w", err)
+	}
+	cfg.Certificates = auth.certificates
+	cfg.RootCAs = auth.cas
+	cfg.ServerName = t.opts.serverName
+	cfg.PinnedSPKI = auth.pins
+	return nil
+}
+
+// tunnelInstance is a running client or server.
+type tunnelInstance struct {
+	io.Closer
+	reload func() error
+}
+
+// start runs prepared tunnel.
+func (t *tunnel) start(ctx context.Context, sessions *session.Registry) (*tunnelInstance, error) {
+	if t.serverCfg != nil {
+		cfg := *t.serverCfg
+		cfg.BaseContext = ctx
+		cfg.Sessions = sessions
+		t.logger.Info("starting dtlspipe server", "bind_address", t.bind, util.LogKeyEndpoint, t.remotes[0])
+		srv, err := server.New(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("server startup failed: %w", err)
+		}
+		return &tunnelInstance{
+			Closer: closerFunc(func() error {
+				defer t.logger.Info("dtlspipe server stopped")
+				return srv.Close()
+			}),
+			reload: t.serverReloader(srv, cfg),
+		}, nil
+	}
+
+	cfg := *t.clientCfg
+	cfg.BaseContext = ctx
+	cfg.Sessions = sessions
+	t.logger.Info("starting dtlspipe client", "bind_address", t.bind, "endpoint_groups", t.remotes)
+	clt, err := client.New(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("client startup failed: %w", err)
+	}
+	return &tunnelInstance{
+		Closer: closerFunc(func() error {
+			defer t.logger.Info("dtlspipe client stopped")
+			return clt.Close()
+		}),
+		reload: t.clientReloader(clt, cfg),
+	}, nil
+}
+
+func (t *tunnel) clientReloader(clt *client.Client, cfg client.Config) func() error {
+	return func() error {
+		if err := t.setClientAuth(&cfg); err != nil {
+			return err
+		}
+		opts, err := t.opts.loadOptions()
+		if err != nil {
+			return fmt.Errorf("can't load options: %w", err)
+		}
+		cfg.IdleTimeout = opts.idleTime
+		cfg.CipherSuites = opts.ciphersuites.Value
+		cfg.TimeLimitFunc = util.TimeLimitFunc(opts.timeLimit.low, opts.timeLimit.high)
+		cfg.AllowFunc = util.AllowByRatelimit(opts.rateLimit.value)
+		if err := clt.Reload(&cfg); err != nil {
+			return err
+		}
+		// resumed sessions skip server verification, so they have to be
+		// dropped when trusted keys change
+		if t.sessCache != nil {
+			if err := t.sessCache.Clear(); err != nil {
+				return fmt.Errorf("can't clear session cache: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+func (t *tunnel) serverReloader(srv *server.Server, cfg server.Config) func() error {
+	return func() error {
+		if err := t.setServerAuth(&cfg); err != nil {
+			return err
+		}
+		opts, err := t.opts.loadOptions()
+		if err != nil {
+			return fmt.Errorf("can't load options: %w", err)
+		}
+		routes, err := t.opts.loadRoutes()
+		if err != nil {
+			return fmt.Errorf("can't load routes: %w", err)
+		}
+		cfg.Routes = routes
+		cfg.IdleTimeout = opts.idleTime
+		cfg.CipherSuites = opts.ciphersuites.Value
+		cfg.TimeLimitFunc = util.TimeLimitFunc(opts.timeLimit.low, opts.timeLimit.high)
+		cfg.AllowFunc = util.AllowByRatelimit(opts.rateLimit.value)
+		return srv.Reload(&cfg)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// runTunnels validates all tunnels, starts them and serves until
+// termination signal. Tunnels are reloaded on SIGHUP.
+func runTunnels(tunnels []*tunnel) int {
+	for _, t := range tunnels {
+		if err := t.prepare(); err != nil {
+			if t.name != "" {
+				err = fmt.Errorf("tunnel %q: %w", t.name, err)
+			}
+			slog.Error("invalid configuration", util.ErrorAttrs(err)...)
+			return 2
+		}
+	}
+
+	appCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	stopMetrics, err := startMetricsServer()
+	if err != nil {
+		slog.Error("can't start metrics server", util.ErrorAttrs(err)...)
+		return 2
+	}
+	defer stopMetrics()
+
+	sessions := session.NewRegistry()
+	stopAdmin, err := startAdminServer(sessions)
+	if err != nil {
+		slog.Error("can't start admin server", util.ErrorAttrs(err)...)
+		return 2
+	}
+	defer stopAdmin()
+
+	instances := make([]*tunnelInstance, 0, len(tunnels))
+	defer func() {
+		for _, inst := range instances {
+			inst.Close()
+		}
+	}()
+	for _, t := range tunnels {
+		inst, err := t.start(appCtx, sessions)
+		if err != nil {
+			t.logger.Error("tunnel startup failed", util.ErrorAttrs(err)...)
+			return 1
+		}
+		instances = append(instances, inst)
+	}
+
+	handleReload(appCtx, func() error {
+		var errs []error
+		for i, inst := range instances {
+			if err := inst.reload(); err != nil {
+				if name := tunnels[i].name; name != "" {
+					err = fmt.Errorf("tunnel %q: %w", name, err)
+				}
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+
+	<-appCtx.Done()
+	return 0
+}
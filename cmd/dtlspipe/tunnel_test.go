@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/ciphers"
+	"github.com/pion/dtls/v3"
+)
+
+func TestPrepareServerKeyRequiresPeers(t *testing.T) {
+	opts := newTunnelOptions()
+	opts.keyFile = "server.key"
+	tun := &tunnel{
+		mode:    modeServer,
+		bind:    "127.0.0.1:2815",
+		remotes: []string{"127.0.0.1:51820"},
+		opts:    opts,
+	}
+	if err := tun.prepare(); err == nil || !strings.Contains(err.Error(), "-peer-keys") {
+		t.Fatalf("server key without allowed peers is accepted: %v", err)
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	dir := t.TempDir()
+	opts := newTunnelOptions()
+	opts.optionsFile = filepath.Join(dir, "options")
+	err := os.WriteFile(opts.optionsFile, []byte(`
+# comment
+idle-time = "1m"
+ciphers = "TLS_PSK_WITH_AES_128_CCM"
+time-limit = "10s-20s"
+rate-limit = "5/1m"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := opts.loadOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded.idleTime != time.Minute {
+		t.Errorf("unexpected idle time: %v", loaded.idleTime)
+	}
+	if !slices.Equal(loaded.ciphersuites.Value, ciphers.CipherList{dtls.TLS_PSK_WITH_AES_128_CCM}) {
+		t.Errorf("unexpected ciphers: %s", loaded.ciphersuites.String())
+	}
+	if loaded.timeLimit.low != 10*time.Second || loaded.timeLimit.high != 20*time.Second {
+		t.Errorf("unexpected time limit: %s", loaded.timeLimit.String())
+	}
+	if loaded.rateLimit.String() == opts.rateLimit.String() {
+		t.Errorf("rate limit is not loaded: %s", loaded.rateLimit.String())
+	}
+	if opts.idleTime == time.Minute {
+		t.Error("command line options are modified")
+	}
+
+	for _, content := range []string{
+		"unknown = 1",
+		"idle-time = \"soon\"",
+		"idle-time = 1m",
+		"ciphers = \"TLS_NULL\"",
+		"psk = \"00112233\"",
+		"[rate-limit]",
+	} {
+		if err := os.WriteFile(opts.optionsFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := opts.loadOptions(); err == nil {
+			t.Errorf("options %q: expected error", content)
+		}
+	}
+	opts.optionsFile = filepath.Join(dir, "missing")
+	if _, err := opts.loadOptions(); err == nil {
+		t.Error("missing options file is loaded")
+	}
+}
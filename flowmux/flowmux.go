@@ -0,0 +1,360 @@
+// Package flowmux multiplexes many datagram flows over one datagram
+// connection. Each datagram is prefixed with frame type and flow ID.
+package flowmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Protocol is ALPN protocol name which identifies multiplexed DTLS
+// connections.
+const Protocol = "dtlspipe-mux/1"
+
+const (
+	frameData  = 0
+	frameClose = 1
+
+	headerLen = 5
+
+	// MaxFlows is a limit of concurrent flows in one connection. Datagrams
+	// opening flows beyond limit are dropped.
+	MaxFlows = 4096
+
+	maxPktBuf   = 65536
+	flowBacklog = 128
+)
+
+var ErrTooManyFlows = errors.New("too many flows")
+
+// Conn is a multiplexed connection. Client side opens flows with Open,
+// server side gets flows opened by peer with Accept.
+type Conn struct {
+	conn        net.Conn
+	server      bool
+	idleTimeout time.Duration
+
+	mux       sync.Mutex
+	flows     map[uint32]*Flow
+	nextID    uint32
+	idleTimer *time.Timer
+
+	writeMux  sync.Mutex
+	acceptCh  chan *Flow
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Client wraps conn for opening flows. Connection is closed after it has
+// no flows for idleTimeout. Zero idleTimeout disables idle close.
+func Client(conn net.Conn, idleTimeout time.Duration) *Conn {
+	return newConn(conn, false, idleTimeout)
+}
+
+// Server wraps conn for accepting flows. Connection is closed after it has
+// no flows for idleTimeout. Zero idleTimeout disables idle close.
+func Server(conn net.Conn, idleTimeout time.Duration) *Conn {
+	return newConn(conn, true, idleTimeout)
+}
+
+func newConn(conn net.Conn, server bool, idleTimeout time.Duration) *Conn {
+	c := &Conn{
+		conn:        conn,
+		server:      server,
+		idleTimeout: idleTimeout,
+		flows:       make(map[uint32]*Flow),
+		acceptCh:    make(chan *Flow, flowBacklog),
+		closed:      make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(idleTimeout, func() {
+			c.Close()
+		})
+	}
+	go c.reader()
+	return c
+}
+
+func (c *Conn) reader() {
+	defer c.Close()
+	buf := make([]byte, maxPktBuf)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < headerLen {
+			continue
+		}
+		id := binary.BigEndian.Uint32(buf[1:headerLen])
+		switch buf[0] {
+		case frameData:
+			flow := c.lookup(id)
+			if flow == nil {
+				continue
+			}
+			flow.deliver(buf[headerLen:n])
+		case frameClose:
+			c.mux.Lock()
+			flow := c.flows[id]
+			c.mux.Unlock()
+			if flow != nil {
+				flow.closeLocal()
+			}
+		}
+	}
+}
+
+// lookup returns flow by ID. On server side flow is created and queued
+// for Accept if it doesn't exist yet.
+func (c *Conn) lookup(id uint32) *Flow {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if flow, ok := c.flows[id]; ok {
+		return flow
+	}
+	if !c.server || len(c.flows) >= MaxFlows {
+		return nil
+	}
+	flow := c.addFlowLocked(id)
+	select {
+	case c.acceptCh <- flow:
+	default:
+		// backlog overflow
+		c.removeFlowLocked(id)
+		return nil
+	}
+	return flow
+}
+
+func (c *Conn) addFlowLocked(id uint32) *Flow {
+	flow := newFlow(c, id)
+	c.flows[id] = flow
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	return flow
+}
+
+func (c *Conn) removeFlowLocked(id uint32) {
+	delete(c.flows, id)
+	if len(c.flows) == 0 && c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+func (c *Conn) removeFlow(flow *Flow) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.flows[flow.id] == flow {
+		c.removeFlowLocked(flow.id)
+	}
+}
+
+// Open opens new flow.
+func (c *Conn) Open() (*Flow, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	if len(c.flows) >= MaxFlows {
+		return nil, ErrTooManyFlows
+	}
+	for {
+		id := c.nextID
+		c.nextID++
+		if _, ok := c.flows[id]; !ok {
+			return c.addFlowLocked(id), nil
+		}
+	}
+}
+
+// Accept waits for flow opened by peer.
+func (c *Conn) Accept() (*Flow, error) {
+	select {
+	case flow := <-c.acceptCh:
+		return flow, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// NumFlows returns number of open flows.
+func (c *Conn) NumFlows() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.flows)
+}
+
+// Done returns channel which is closed when connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+func (c *Conn) writeFrame(frameType byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerLen, headerLen+len(payload))
+	buf[0] = frameType
+	binary.BigEndian.PutUint32(buf[1:], id)
+	buf = append(buf, payload...)
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes connection and all its flows.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.mux.Lock()
+		close(c.closed)
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		flows := c.flows
+		c.flows = make(map[uint32]*Flow)
+		c.mux.Unlock()
+		for _, flow := range flows {
+			flow.closeLocal()
+		}
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Flow is a single datagram flow within multiplexed connection.
+type Flow struct {
+	c    *Conn
+	id   uint32
+	recv chan []byte
+
+	mux          sync.Mutex
+	readDeadline time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func newFlow(c *Conn, id uint32) *Flow {
+	return &Flow{
+		c:      c,
+		id:     id,
+		recv:   make(chan []byte, flowBacklog),
+		closed: make(chan struct{}),
+	}
+}
+
+// deliver queues datagram for reading. Datagram is dropped if queue is
+// full.
+func (f *Flow) deliver(b []byte) {
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	select {
+	case f.recv <- buf:
+	default:
+	}
+}
+
+// ID returns flow ID.
+func (f *Flow) ID() uint32 {
+	return f.id
+}
+
+func (f *Flow) Read(b []byte) (int, error) {
+	f.mux.Lock()
+	deadline := f.readDeadline
+	f.mux.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case data := <-f.recv:
+		return copy(b, data), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-f.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (f *Flow) Write(b []byte) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := f.c.writeFrame(frameData, f.id, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// closeLocal closes flow without notification of peer.
+func (f *Flow) closeLocal() {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.c.removeFlow(f)
+	})
+}
+
+// Close closes flow and notifies peer about it.
+func (f *Flow) Close() error {
+	var notify bool
+	f.closeOnce.Do(func() {
+		notify = true
+		close(f.closed)
+		f.c.removeFlow(f)
+	})
+	if notify {
+		select {
+		case <-f.c.closed:
+		default:
+			f.c.writeFrame(frameClose, f.id, nil)
+		}
+	}
+	return nil
+}
+
+func (f *Flow) LocalAddr() net.Addr {
+	return f.c.LocalAddr()
+}
+
+func (f *Flow) RemoteAddr() net.Addr {
+	return f.c.RemoteAddr()
+}
+
+// SetDeadline sets read deadline for subsequent Read calls. Writes are
+// not blocking.
+func (f *Flow) SetDeadline(t time.Time) error {
+	return f.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets deadline for subsequent Read calls. Read already in
+// progress is not affected.
+func (f *Flow) SetReadDeadline(t time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.readDeadline = t
+	return nil
+}
+
+func (f *Flow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
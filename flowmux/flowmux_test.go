@@ -0,0 +1,98 @@
+package flowmux
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFlows(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	client := Client(clientSide, 0)
+	defer client.Close()
+	server := Server(serverSide, 0)
+	defer server.Close()
+
+	buf := make([]byte, 16)
+	var clientFlows, serverFlows []*Flow
+	for i := 0; i < 3; i++ {
+		flow, err := client.Open()
+		if err != nil {
+			t.Fatalf("open failed: %v", err)
+		}
+		clientFlows = append(clientFlows, flow)
+		if _, err := flow.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		accepted, err := server.Accept()
+		if err != nil {
+			t.Fatalf("accept failed: %v", err)
+		}
+		serverFlows = append(serverFlows, accepted)
+		if n, err := accepted.Read(buf); err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("unexpected read: %v, %v", buf[:n], err)
+		}
+	}
+
+	// reply goes to the right flow
+	if _, err := serverFlows[1].Write([]byte("reply")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if n, err := clientFlows[1].Read(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+	clientFlows[0].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := clientFlows[0].Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	// close is propagated to peer
+	serverFlows[2].Close()
+	if _, err := clientFlows[2].Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed flow, got %v", err)
+	}
+	if n := client.NumFlows(); n != 2 {
+		t.Errorf("unexpected number of client flows: %d", n)
+	}
+
+	// closing connection closes all flows
+	client.Close()
+	if _, err := serverFlows[0].Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed flow, got %v", err)
+	}
+}
+
+func TestIdleClose(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	client := Client(clientSide, 100*time.Millisecond)
+	defer client.Close()
+
+	flow, err := client.Open()
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := serverSide.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-client.Done():
+		t.Fatal("connection with open flow closed")
+	default:
+	}
+
+	flow.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle connection is not closed")
+	}
+}
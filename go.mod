@@ -5,14 +5,15 @@ go 1.23.0
 toolchain go1.24.6
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/Snawoot/rlzone v0.2.0
 	github.com/pion/dtls/v3 v3.0.7
 	github.com/pion/transport/v3 v3.0.7
+	golang.org/x/crypto v0.41.0
 )
 
 require (
 	github.com/pion/logging v0.2.4 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 )
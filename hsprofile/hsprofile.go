@@ -0,0 +1,259 @@
+// Package hsprofile shapes DTLS ClientHello like handshakes of common
+// WebRTC stacks, so tunnel handshakes blend into browser traffic.
+package hsprofile
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+
+	"github.com/SenseUnit/dtlspipe/ciphers"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/hash"
+	"github.com/pion/dtls/v3/pkg/crypto/signature"
+	"github.com/pion/dtls/v3/pkg/crypto/signaturehash"
+	"github.com/pion/dtls/v3/pkg/protocol"
+	"github.com/pion/dtls/v3/pkg/protocol/extension"
+	"github.com/pion/dtls/v3/pkg/protocol/handshake"
+)
+
+// Cipher suites offered by browsers which are not implemented by DTLS
+// library. They are offered, but never negotiated.
+const (
+	tlsEcdheEcdsaWithChacha20Poly1305 = 0xcca9
+	tlsEcdheRsaWithChacha20Poly1305   = 0xcca8
+	tlsEcdheEcdsaWithAes128CbcSha     = 0xc009
+	tlsEcdheRsaWithAes128CbcSha       = 0xc013
+)
+
+// Profile describes shape of ClientHello.
+type Profile struct {
+	Name string
+	// CipherSuites are offered in this order. Cipher suites configured
+	// for connection which are not listed are offered after them.
+	CipherSuites []uint16
+	// SignatureSchemes are offered in signature_algorithms extension.
+	SignatureSchemes []tls.SignatureScheme
+	// SRTPProtectionProfiles are offered in use_srtp extension.
+	SRTPProtectionProfiles []dtls.SRTPProtectionProfile
+	// ExtensionOrder lists extension types in order they are sent.
+	// Extensions not listed are sent after them.
+	ExtensionOrder []extension.TypeValue
+	// RecordVersion is version of record carrying ClientHello.
+	RecordVersion protocol.Version
+}
+
+var webRTCSignatureSchemes = []tls.SignatureScheme{
+	tls.ECDSAWithP256AndSHA256,
+	tls.PSSWithSHA256,
+	tls.PKCS1WithSHA256,
+	tls.ECDSAWithP384AndSHA384,
+	tls.PSSWithSHA384,
+	tls.PKCS1WithSHA384,
+	tls.PSSWithSHA512,
+	tls.PKCS1WithSHA512,
+}
+
+var webRTCExtensionOrder = []extension.TypeValue{
+	extension.ServerNameTypeValue,
+	extension.UseExtendedMasterSecretTypeValue,
+	extension.RenegotiationInfoTypeValue,
+	extension.SupportedEllipticCurvesTypeValue,
+	extension.SupportedPointFormatsTypeValue,
+	extension.ALPNTypeValue,
+	extension.SupportedSignatureAlgorithmsTypeValue,
+	extension.UseSRTPTypeValue,
+}
+
+var profiles = map[string]*Profile{
+	"chrome": {
+		Name: "chrome",
+		CipherSuites: []uint16{
+			uint16(dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256),
+			uint16(dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256),
+			tlsEcdheEcdsaWithChacha20Poly1305,
+			tlsEcdheRsaWithChacha20Poly1305,
+			tlsEcdheEcdsaWithAes128CbcSha,
+			tlsEcdheRsaWithAes128CbcSha,
+			uint16(dtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA),
+			uint16(dtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA),
+		},
+		SignatureSchemes: webRTCSignatureSchemes,
+		SRTPProtectionProfiles: []dtls.SRTPProtectionProfile{
+			dtls.SRTP_AEAD_AES_128_GCM,
+			dtls.SRTP_AEAD_AES_256_GCM,
+			dtls.SRTP_AES128_CM_HMAC_SHA1_80,
+		},
+		ExtensionOrder: webRTCExtensionOrder,
+		RecordVersion:  protocol.Version1_0,
+	},
+	"firefox": {
+		Name: "firefox",
+		CipherSuites: []uint16{
+			uint16(dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256),
+			uint16(dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256),
+			tlsEcdheEcdsaWithChacha20Poly1305,
+			tlsEcdheRsaWithChacha20Poly1305,
+			uint16(dtls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384),
+			uint16(dtls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384),
+			uint16(dtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA),
+			tlsEcdheEcdsaWithAes128CbcSha,
+			tlsEcdheRsaWithAes128CbcSha,
+			uint16(dtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA),
+		},
+		SignatureSchemes: webRTCSignatureSchemes,
+		SRTPProtectionProfiles: []dtls.SRTPProtectionProfile{
+			dtls.SRTP_AEAD_AES_128_GCM,
+			dtls.SRTP_AEAD_AES_256_GCM,
+			dtls.SRTP_AES128_CM_HMAC_SHA1_80,
+			dtls.SRTP_AES128_CM_HMAC_SHA1_32,
+		},
+		ExtensionOrder: webRTCExtensionOrder,
+		RecordVersion:  protocol.Version1_0,
+	},
+}
+
+// SRTPProtectionProfiles is union of SRTP protection profiles of all
+// profiles. Server configured with them accepts ClientHello of any profile.
+var SRTPProtectionProfiles = []dtls.SRTPProtectionProfile{
+	dtls.SRTP_AEAD_AES_128_GCM,
+	dtls.SRTP_AEAD_AES_256_GCM,
+	dtls.SRTP_AES128_CM_HMAC_SHA1_80,
+	dtls.SRTP_AES128_CM_HMAC_SHA1_32,
+}
+
+// Get returns profile by name.
+func Get(name string) (*Profile, error) {
+	if p, ok := profiles[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown handshake profile %q", name)
+}
+
+// Names returns sorted names of available profiles.
+func Names() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply configures cfg for handshakes with ClientHello shaped by profile.
+// Cipher suites of profile implemented by DTLS library are enabled in
+// addition to configured ones, so any of offered suites chosen by server
+// is accepted. Configured curves are kept and offered in browser order.
+// Browsers offer all curves supported by dtlspipe, so restricting curves
+// makes ClientHello differ from browser one.
+func (p *Profile) Apply(cfg *dtls.Config) {
+	var suites ciphers.CipherList
+	for _, id := range p.CipherSuites {
+		if slices.Contains(ciphers.FullCipherList, dtls.CipherSuiteID(id)) {
+			suites = append(suites, dtls.CipherSuiteID(id))
+		}
+	}
+	for _, id := range cfg.CipherSuites {
+		if !slices.Contains(suites, id) {
+			suites = append(suites, id)
+		}
+	}
+	cfg.CipherSuites = suites
+	if len(cfg.EllipticCurves) > 0 {
+		var curves ciphers.CurveList
+		for _, curve := range ciphers.FullCurveList {
+			if slices.Contains(cfg.EllipticCurves, curve) {
+				curves = append(curves, curve)
+			}
+		}
+		cfg.EllipticCurves = curves
+	}
+	cfg.SRTPProtectionProfiles = p.SRTPProtectionProfiles
+	cfg.ClientHelloMessageHook = p.shapeClientHello
+}
+
+func (p *Profile) shapeClientHello(hello handshake.MessageClientHello) handshake.Message {
+	suites := slices.Clone(p.CipherSuites)
+	for _, id := range hello.CipherSuiteIDs {
+		if !slices.Contains(suites, id) {
+			suites = append(suites, id)
+		}
+	}
+	hello.CipherSuiteIDs = suites
+
+	extensions := slices.Clone(hello.Extensions)
+	for i, ext := range extensions {
+		if _, ok := ext.(*extension.SupportedSignatureAlgorithms); ok {
+			extensions[i] = &extension.SupportedSignatureAlgorithms{
+				SignatureHashAlgorithms: signatureAlgorithms(p.SignatureSchemes),
+			}
+		}
+	}
+	rank := func(ext extension.Extension) int {
+		if i := slices.Index(p.ExtensionOrder, ext.TypeValue()); i >= 0 {
+			return i
+		}
+		return len(p.ExtensionOrder)
+	}
+	slices.SortStableFunc(extensions, func(a, b extension.Extension) int {
+		return rank(a) - rank(b)
+	})
+	hello.Extensions = extensions
+	return &hello
+}
+
+// signatureAlgorithms converts schemes to wire representation. Schemes
+// unknown to DTLS library are kept as is: they're only offered, while
+// signature is verified against schemes supported by library.
+func signatureAlgorithms(schemes []tls.SignatureScheme) []signaturehash.Algorithm {
+	algs := make([]signaturehash.Algorithm, 0, len(schemes))
+	for _, scheme := range schemes {
+		algs = append(algs, signaturehash.Algorithm{
+			Hash:      hash.Algorithm(scheme >> 8),
+			Signature: signature.Algorithm(scheme & 0xff),
+		})
+	}
+	return algs
+}
+
+// PacketConn rewrites record version of ClientHello datagrams sent to
+// underlying connection.
+type PacketConn struct {
+	net.PacketConn
+	version protocol.Version
+}
+
+// NewPacketConn wraps conn to send ClientHello records with record
+// version of profile.
+func (p *Profile) NewPacketConn(conn net.PacketConn) *PacketConn {
+	return &PacketConn{
+		PacketConn: conn,
+		version:    p.RecordVersion,
+	}
+}
+
+// Record header layout: content type (1), version (2), epoch (2),
+// sequence number (6), length (2), followed by handshake type (1).
+const (
+	recordVersionOffset = 1
+	recordEpochOffset   = 3
+	handshakeTypeOffset = 13
+)
+
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if isClientHello(p) && c.version != (protocol.Version{}) {
+		p = slices.Clone(p)
+		p[recordVersionOffset] = c.version.Major
+		p[recordVersionOffset+1] = c.version.Minor
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func isClientHello(p []byte) bool {
+	return len(p) > handshakeTypeOffset &&
+		protocol.ContentType(p[0]) == protocol.ContentTypeHandshake &&
+		p[recordEpochOffset] == 0 && p[recordEpochOffset+1] == 0 &&
+		handshake.Type(p[handshakeTypeOffset]) == handshake.TypeClientHello
+}
@@ -0,0 +1,114 @@
+package hsprofile
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/elliptic"
+	"github.com/pion/dtls/v3/pkg/protocol/extension"
+	"github.com/pion/dtls/v3/pkg/protocol/handshake"
+)
+
+func TestShapeClientHello(t *testing.T) {
+	p, err := Get("chrome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &dtls.Config{
+		CipherSuites:   []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM},
+		EllipticCurves: []elliptic.Curve{elliptic.P384, elliptic.X25519},
+	}
+	p.Apply(cfg)
+	if !slices.Equal(cfg.EllipticCurves, []elliptic.Curve{elliptic.X25519, elliptic.P384}) {
+		t.Errorf("unexpected curves %v", cfg.EllipticCurves)
+	}
+	expected := []dtls.CipherSuiteID{
+		dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_PSK_WITH_AES_128_CCM,
+	}
+	if !slices.Equal(cfg.CipherSuites, expected) {
+		t.Errorf("unexpected cipher suites %v", cfg.CipherSuites)
+	}
+
+	hello := handshake.MessageClientHello{
+		CipherSuiteIDs: []uint16{uint16(dtls.TLS_PSK_WITH_AES_128_CCM)},
+		Extensions: []extension.Extension{
+			&extension.SupportedSignatureAlgorithms{},
+			&extension.RenegotiationInfo{},
+			&extension.UseSRTP{},
+			&extension.ConnectionID{},
+			&extension.UseExtendedMasterSecret{},
+		},
+	}
+	shaped := cfg.ClientHelloMessageHook(hello).(*handshake.MessageClientHello)
+	if !slices.Equal(shaped.CipherSuiteIDs[:len(p.CipherSuites)], p.CipherSuites) ||
+		shaped.CipherSuiteIDs[len(p.CipherSuites)] != uint16(dtls.TLS_PSK_WITH_AES_128_CCM) {
+		t.Errorf("unexpected offered cipher suites %x", shaped.CipherSuiteIDs)
+	}
+	var order []extension.TypeValue
+	for _, ext := range shaped.Extensions {
+		order = append(order, ext.TypeValue())
+	}
+	expectedOrder := []extension.TypeValue{
+		extension.UseExtendedMasterSecretTypeValue,
+		extension.RenegotiationInfoTypeValue,
+		extension.SupportedSignatureAlgorithmsTypeValue,
+		extension.UseSRTPTypeValue,
+		extension.ConnectionIDTypeValue,
+	}
+	if !slices.Equal(order, expectedOrder) {
+		t.Errorf("unexpected extension order %v", order)
+	}
+	sigs := shaped.Extensions[2].(*extension.SupportedSignatureAlgorithms)
+	if len(sigs.SignatureHashAlgorithms) != len(p.SignatureSchemes) {
+		t.Errorf("unexpected signature algorithms %v", sigs.SignatureHashAlgorithms)
+	}
+	if _, err := shaped.Marshal(); err != nil {
+		t.Errorf("shaped ClientHello can't be marshaled: %v", err)
+	}
+
+	if _, err := Get("netscape"); err == nil {
+		t.Error("unknown profile is found")
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := Get("firefox")
+	conn := p.NewPacketConn(sender)
+	defer conn.Close()
+
+	clientHello := []byte{22, 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1}
+	serverHello := []byte{22, 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2}
+	buf := make([]byte, 64)
+	for _, datagram := range [][]byte{clientHello, serverHello} {
+		if _, err := conn.WriteTo(datagram, receiver.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := slices.Clone(datagram)
+		if datagram[handshakeTypeOffset] == byte(handshake.TypeClientHello) {
+			expected[1], expected[2] = 0xfe, 0xff
+		}
+		if !slices.Equal(buf[:n], expected) {
+			t.Errorf("unexpected datagram %x", buf[:n])
+		}
+	}
+	if clientHello[2] != 0xfd {
+		t.Error("buffer of caller is modified")
+	}
+}
@@ -0,0 +1,75 @@
+package keystore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	identity string
+	psk      []byte
+	err      error
+	expires  time.Time
+}
+
+// keyCache is LRU cache of keys and key lookup errors. Least recently
+// used entry is evicted when cache is full, so lookups of unknown
+// identities can't flush keys which are in use.
+type keyCache struct {
+	mux     sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns cached lookup result for identity.
+func (c *keyCache) get(identity []byte) (cacheEntry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	elem, ok := c.entries[string(identity)]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, entry.identity)
+		return cacheEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return *entry, true
+}
+
+// put caches lookup result for identity. Zero ttl means entry doesn't
+// expire.
+func (c *keyCache) put(identity, psk []byte, err error, ttl time.Duration) {
+	entry := &cacheEntry{
+		identity: string(identity),
+		psk:      psk,
+		err:      err,
+	}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if elem, ok := c.entries[entry.identity]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).identity)
+	}
+	c.entries[entry.identity] = c.lru.PushFront(entry)
+}
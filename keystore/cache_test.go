@@ -0,0 +1,36 @@
+package keystore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeyCache(t *testing.T) {
+	cache := newKeyCache(2)
+	cache.put([]byte("alice"), []byte{1}, nil, 0)
+	cache.put([]byte("bob"), []byte{2}, nil, 0)
+	if _, ok := cache.get([]byte("alice")); !ok {
+		t.Fatal("alice is not cached")
+	}
+	// bob is least recently used now
+	cache.put([]byte("mallory"), nil, errors.New("unknown identity"), 0)
+	if _, ok := cache.get([]byte("bob")); ok {
+		t.Error("least recently used entry is not evicted")
+	}
+	if entry, ok := cache.get([]byte("alice")); !ok || entry.psk[0] != 1 {
+		t.Error("recently used entry is evicted")
+	}
+	if entry, ok := cache.get([]byte("mallory")); !ok || entry.err == nil {
+		t.Error("lookup error is not cached")
+	}
+
+	cache.put([]byte("carol"), []byte{3}, nil, 50*time.Millisecond)
+	if _, ok := cache.get([]byte("carol")); !ok {
+		t.Fatal("carol is not cached")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := cache.get([]byte("carol")); ok {
+		t.Error("expired entry is returned")
+	}
+}
@@ -0,0 +1,103 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+// ExecIdentityEnvVarKey is the name of environment variable which passes
+// identity hint to the key helper program.
+const ExecIdentityEnvVarKey = "DTLSPIPE_IDENTITY"
+
+const (
+	// maxHelpers bounds number of concurrently running helper programs.
+	maxHelpers = 4
+	// failureTTL is the longest time failed lookups are cached for.
+	failureTTL = 5 * time.Second
+)
+
+// ExecKeystore obtains keys from external helper program. Helper is
+// invoked with identity in DTLSPIPE_IDENTITY environment variable and
+// should output hex-encoded key on the first line of stdout and exit with
+// zero code. Successful results are cached for ttl, failures are cached
+// for ttl or 5 seconds, whichever is shorter. At most 4 helpers run
+// concurrently, other lookups wait for them.
+type ExecKeystore struct {
+	command []string
+	timeout time.Duration
+	ttl     time.Duration
+	cache   *keyCache
+	sem     chan struct{}
+}
+
+func NewExecKeystore(command []string, timeout, ttl time.Duration) (*ExecKeystore, error) {
+	if len(command) == 0 {
+		return nil, errors.New("empty key helper command")
+	}
+	return &ExecKeystore{
+		command: command,
+		timeout: timeout,
+		ttl:     ttl,
+		cache:   newKeyCache(maxCachedKeys),
+		sem:     make(chan struct{}, maxHelpers),
+	}, nil
+}
+
+func (store *ExecKeystore) PSKCallback(hint []byte) ([]byte, error) {
+	if entry, ok := store.cache.get(hint); ok {
+		return entry.psk, entry.err
+	}
+	store.sem <- struct{}{}
+	defer func() { <-store.sem }()
+	// lookup might be done while waiting for semaphore
+	if entry, ok := store.cache.get(hint); ok {
+		return entry.psk, entry.err
+	}
+	psk, err := store.run(hint)
+	if store.ttl > 0 {
+		ttl := store.ttl
+		if err != nil {
+			ttl = min(ttl, failureTTL)
+		}
+		store.cache.put(hint, psk, err, ttl)
+	}
+	return psk, err
+}
+
+func (store *ExecKeystore) run(hint []byte) ([]byte, error) {
+	ctx := context.Background()
+	if store.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, store.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, store.command[0], store.command[1:]...)
+	cmd.Env = append(os.Environ(), ExecIdentityEnvVarKey+"="+string(hint))
+	// don't wait for orphaned children holding stdout after timeout
+	cmd.WaitDelay = store.timeout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	defer clear(out)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("key helper failed for identity %q: %w", hint, err)
+	}
+	psk, err := util.ReadPSKHex(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("bad key helper output for identity %q: %w", hint, err)
+	}
+	return psk, nil
+}
@@ -0,0 +1,81 @@
+package keystore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecKeystore(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "calls")
+	store, err := NewExecKeystore([]string{
+		"sh", "-c", `echo x >> "$0"; echo " 0011223344556677$DTLSPIPE_IDENTITY "`, counter,
+	}, 5*time.Second, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for range 2 {
+		psk, err := store.PSKCallback([]byte("aa"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(psk, []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0xaa}) {
+			t.Fatalf("unexpected key: %x", psk)
+		}
+	}
+	calls, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatalf("can't read counter file: %v", err)
+	}
+	if string(calls) != "x\n" {
+		t.Errorf("helper invoked unexpected number of times: %q", calls)
+	}
+}
+
+func TestExecKeystoreErrors(t *testing.T) {
+	for _, script := range []string{
+		"exit 1",
+		"echo not-hex",
+		"sleep 5",
+	} {
+		store, err := NewExecKeystore([]string{"sh", "-c", script}, 200*time.Millisecond, time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		start := time.Now()
+		if _, err := store.PSKCallback([]byte("aa")); err == nil {
+			t.Errorf("script %q: expected error", script)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("script %q: timeout is not respected", script)
+		}
+	}
+}
+
+func TestExecKeystoreFailureCache(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "calls")
+	store, err := NewExecKeystore([]string{
+		"sh", "-c", `echo x >> "$0"; exit 1`, counter,
+	}, 5*time.Second, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for range 2 {
+		if _, err := store.PSKCallback([]byte("aa")); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err := store.PSKCallback([]byte("aa")); err == nil {
+		t.Fatal("expected error")
+	}
+	calls, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatalf("can't read counter file: %v", err)
+	}
+	if string(calls) != "x\nx\n" {
+		t.Errorf("helper invoked unexpected number of times: %q", calls)
+	}
+}
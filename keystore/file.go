@@ -0,0 +1,82 @@
+package keystore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type FileKeystore struct {
+	keys map[string][]byte
+}
+
+func NewFileKeystore(filename string) (*FileKeystore, error) {
+	keys, err := LoadKeysFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeystore{
+		keys: keys,
+	}, nil
+}
+
+func (store *FileKeystore) PSKCallback(hint []byte) ([]byte, error) {
+	psk, ok := store.keys[string(hint)]
+	if !ok {
+		return nil, fmt.Errorf("unknown identity %q", hint)
+	}
+	return psk, nil
+}
+
+func LoadKeysFile(filename string) (map[string][]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't open keys file: %w", err)
+	}
+	defer f.Close()
+	keys, err := ParseKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't load keys file %q: %w", filename, err)
+	}
+	return keys, nil
+}
+
+// ParseKeys reads identity to PSK mapping. Each non-empty line holds
+// identity and hex-encoded PSK separated by whitespace. Lines starting
+// with '#' are ignored.
+func ParseKeys(r io.Reader) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected identity and key, got %d fields", lineNum, len(fields))
+		}
+		identity, keyHex := fields[0], fields[1]
+		if _, ok := keys[identity]; ok {
+			return nil, fmt.Errorf("line %d: duplicate identity %q", lineNum, identity)
+		}
+		psk, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: can't hex-decode PSK: %w", lineNum, err)
+		}
+		if len(psk) == 0 {
+			return nil, fmt.Errorf("line %d: empty PSK", lineNum)
+		}
+		keys[identity] = bytes.Clone(psk)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("keys read failed: %w", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,56 @@
+package keystore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	input := `
+# comment
+alice 00112233445566778899aabbccddeeff
+
+bob	ffeeddccbbaa99887766554433221100
+`
+	keys, err := ParseKeys(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("unexpected keys count: %d", len(keys))
+	}
+	if !bytes.Equal(keys["alice"], []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}) {
+		t.Errorf("unexpected key for alice: %x", keys["alice"])
+	}
+	if _, ok := keys["bob"]; !ok {
+		t.Errorf("key for bob not found")
+	}
+}
+
+func TestParseKeysErrors(t *testing.T) {
+	for _, input := range []string{
+		"alice",
+		"alice 0011 2233",
+		"alice zz",
+		"alice 00\nalice 11",
+	} {
+		if _, err := ParseKeys(strings.NewReader(input)); err == nil {
+			t.Errorf("expected error for input %q", input)
+		}
+	}
+}
+
+func TestFileKeystoreUnknownIdentity(t *testing.T) {
+	store := &FileKeystore{
+		keys: map[string][]byte{
+			"alice": {1, 2, 3},
+		},
+	}
+	if psk, err := store.PSKCallback([]byte("alice")); err != nil || !bytes.Equal(psk, []byte{1, 2, 3}) {
+		t.Errorf("unexpected lookup result: %x, %v", psk, err)
+	}
+	if _, err := store.PSKCallback([]byte("mallory")); err == nil {
+		t.Errorf("expected error for unknown identity")
+	}
+}
@@ -0,0 +1,14 @@
+package keystore
+
+// maxCachedKeys limits number of derived or fetched keys kept in memory.
+const maxCachedKeys = 1024
+
+type Keystore interface {
+	PSKCallback(hint []byte) ([]byte, error)
+}
+
+func IdentityPSKCallback(store Keystore, identity string) func([]byte) ([]byte, error) {
+	return func(_ []byte) ([]byte, error) {
+		return store.PSKCallback([]byte(identity))
+	}
+}
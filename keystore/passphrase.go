@@ -0,0 +1,103 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/rlzone"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters of passphrase-based key derivation. Changing them
+// changes derived keys.
+const (
+	DerivedPSKLength = 32
+
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	kdfSalt    = "dtlspipe-psk/"
+
+	// maxDerivations bounds number of concurrent derivations and memory
+	// used by them.
+	maxDerivations = 2
+	// derivationBudget bounds number of derivations per minute. Lookups
+	// of identities which aren't cached, e.g. by unauthenticated knocks
+	// and handshakes, can't take more CPU time than that.
+	derivationBudget = 30
+)
+
+// ErrDerivationLimited is returned for identity which isn't cached when
+// derivation budget is exhausted.
+var ErrDerivationLimited = errors.New("key derivation budget is exhausted")
+
+// DerivePSK derives PSK from passphrase with Argon2id, using identity as
+// salt.
+func DerivePSK(passphrase, identity []byte) []byte {
+	salt := append([]byte(kdfSalt), identity...)
+	return argon2.IDKey(passphrase, salt, kdfTime, kdfMemory, kdfThreads, DerivedPSKLength)
+}
+
+type derivation struct {
+	done chan struct{}
+	psk  []byte
+}
+
+// PassphraseKeystore derives key for each identity from a single
+// passphrase. Derived keys are kept in LRU cache. Number of concurrent
+// derivations is bounded to limit memory use, and concurrent lookups of
+// the same identity share a single derivation. Derivations are limited
+// by global budget regardless of lookup origin, so identities which
+// aren't cached fail lookup when budget is exhausted while cached ones
+// keep working.
+type PassphraseKeystore struct {
+	passphrase []byte
+	cache      *keyCache
+	sem        chan struct{}
+	budget     rlzone.Ratelimiter[struct{}]
+	mux        sync.Mutex
+	pending    map[string]*derivation
+}
+
+func NewPassphraseKeystore(passphrase []byte) *PassphraseKeystore {
+	return &PassphraseKeystore{
+		passphrase: bytes.Clone(passphrase),
+		cache:      newKeyCache(maxCachedKeys),
+		sem:        make(chan struct{}, maxDerivations),
+		budget:     rlzone.Must(rlzone.NewSmallest[struct{}](time.Minute, derivationBudget)),
+		pending:    make(map[string]*derivation),
+	}
+}
+
+func (store *PassphraseKeystore) PSKCallback(hint []byte) ([]byte, error) {
+	if entry, ok := store.cache.get(hint); ok {
+		return entry.psk, nil
+	}
+	store.mux.Lock()
+	d, ok := store.pending[string(hint)]
+	if !ok {
+		if !store.budget.Allow(struct{}{}) {
+			store.mux.Unlock()
+			return nil, ErrDerivationLimited
+		}
+		d = &derivation{done: make(chan struct{})}
+		store.pending[string(hint)] = d
+	}
+	store.mux.Unlock()
+	if ok {
+		<-d.done
+		return d.psk, nil
+	}
+
+	store.sem <- struct{}{}
+	d.psk = DerivePSK(store.passphrase, hint)
+	<-store.sem
+	store.cache.put(hint, d.psk, nil, 0)
+	store.mux.Lock()
+	delete(store.pending, string(hint))
+	store.mux.Unlock()
+	close(d.done)
+	return d.psk, nil
+}
@@ -0,0 +1,76 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Snawoot/rlzone"
+)
+
+func TestPassphraseKeystore(t *testing.T) {
+	store := NewPassphraseKeystore([]byte("correct horse battery staple"))
+	alice, err := store.PSKCallback([]byte("alice"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(alice) != DerivedPSKLength {
+		t.Fatalf("unexpected key length: %d", len(alice))
+	}
+	if !bytes.Equal(alice, DerivePSK([]byte("correct horse battery staple"), []byte("alice"))) {
+		t.Errorf("keystore key doesn't match derived key")
+	}
+	bob, _ := store.PSKCallback([]byte("bob"))
+	if bytes.Equal(alice, bob) {
+		t.Errorf("keys for different identities are equal")
+	}
+	if other := DerivePSK([]byte("another passphrase"), []byte("alice")); bytes.Equal(alice, other) {
+		t.Errorf("keys for different passphrases are equal")
+	}
+}
+
+func TestPassphraseKeystoreConcurrent(t *testing.T) {
+	store := NewPassphraseKeystore([]byte("correct horse battery staple"))
+	want := DerivePSK([]byte("correct horse battery staple"), []byte("alice"))
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if psk, _ := store.PSKCallback([]byte("alice")); !bytes.Equal(psk, want) {
+				t.Errorf("unexpected key %x", psk)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(store.pending) != 0 {
+		t.Errorf("derivations are left pending: %d", len(store.pending))
+	}
+}
+
+func TestDerivePSKVector(t *testing.T) {
+	// guards against accidental change of derivation parameters
+	const want = "d1ce558e10b43b30440310c9e20df9d6bb637dd160a544654d251d45a7abaa3d"
+	if got := hex.EncodeToString(DerivePSK([]byte("passphrase"), []byte("alice"))); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPassphraseKeystoreBudget(t *testing.T) {
+	store := NewPassphraseKeystore([]byte("correct horse battery staple"))
+	store.budget = rlzone.Must(rlzone.NewSmallest[struct{}](time.Minute, 1))
+	alice, err := store.PSKCallback([]byte("alice"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := store.PSKCallback([]byte("mallory")); !errors.Is(err, ErrDerivationLimited) {
+		t.Fatalf("derivation over budget is not refused: %v", err)
+	}
+	// cached keys don't need derivation
+	if psk, err := store.PSKCallback([]byte("alice")); err != nil || !bytes.Equal(psk, alice) {
+		t.Errorf("cached key lookup failed: %v", err)
+	}
+}
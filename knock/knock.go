@@ -0,0 +1,311 @@
+// Package knock implements pre-authentication of client source addresses.
+// Server stays silent to source address until it receives valid knock
+// datagram authenticated with pre-shared key or knock sequence over ports.
+package knock
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Snawoot/rlzone"
+)
+
+const (
+	nonceSize     = 16
+	timestampSize = 8
+	macSize       = sha256.Size
+	headerSize    = nonceSize + timestampSize
+
+	// MinSize is size of knock datagram with empty identity.
+	MinSize = headerSize + macSize
+
+	// DefaultWindow is default maximal difference between knock timestamp
+	// and server time.
+	DefaultWindow = 30 * time.Second
+
+	// DefaultTTL is default time source address is allowed after knock.
+	DefaultTTL = 30 * time.Second
+
+	// DefaultRateLimit is default number of knock datagrams accepted for
+	// verification from a single source address per minute.
+	DefaultRateLimit = 20
+
+	// maxEntries bounds number of tracked addresses and nonces.
+	maxEntries = 65536
+)
+
+var keyLabel = []byte("dtlspipe-knock/1")
+
+var (
+	ErrMalformed = errors.New("malformed knock")
+	ErrBadMAC    = errors.New("knock authentication failed")
+	ErrExpired   = errors.New("knock timestamp is out of window")
+	ErrReplayed  = errors.New("knock is replayed")
+	ErrLimited   = errors.New("knock rate limit exceeded")
+)
+
+// deriveKey derives knock key from pre-shared key, so knock MAC doesn't
+// use pre-shared key directly.
+func deriveKey(psk []byte) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(keyLabel)
+	return mac.Sum(nil)
+}
+
+// New creates knock datagram of identity authenticated with psk.
+func New(identity, psk []byte) ([]byte, error) {
+	pkt := make([]byte, headerSize, MinSize+len(identity))
+	if _, err := rand.Read(pkt[:nonceSize]); err != nil {
+		return nil, fmt.Errorf("can't generate knock nonce: %w", err)
+	}
+	binary.BigEndian.PutUint64(pkt[nonceSize:], uint64(time.Now().Unix()))
+	pkt = append(pkt, identity...)
+	mac := hmac.New(sha256.New, deriveKey(psk))
+	mac.Write(pkt)
+	return mac.Sum(pkt), nil
+}
+
+// Knock is parsed knock datagram.
+type Knock struct {
+	Nonce     []byte
+	Timestamp time.Time
+	Identity  []byte
+	pkt       []byte
+}
+
+// Parse parses knock datagram without verification.
+func Parse(pkt []byte) (*Knock, error) {
+	if len(pkt) < MinSize {
+		return nil, ErrMalformed
+	}
+	body := pkt[:len(pkt)-macSize]
+	return &Knock{
+		Nonce:     body[:nonceSize],
+		Timestamp: time.Unix(int64(binary.BigEndian.Uint64(body[nonceSize:])), 0),
+		Identity:  body[headerSize:],
+		pkt:       pkt,
+	}, nil
+}
+
+// Verify checks knock MAC with psk.
+func (k *Knock) Verify(psk []byte) error {
+	body := k.pkt[:len(k.pkt)-macSize]
+	mac := hmac.New(sha256.New, deriveKey(psk))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), k.pkt[len(body):]) {
+		return ErrBadMAC
+	}
+	return nil
+}
+
+// GateConfig configures Gate.
+type GateConfig struct {
+	// Authenticated requires knock datagram authenticated with pre-shared
+	// key.
+	Authenticated bool
+	// Sequence is length of knock sequence over ports. Zero value
+	// disables knock sequence. If both knock kinds are enabled, sequence
+	// has to be completed before knock datagram.
+	Sequence int
+	// TTL is time source address is allowed after knock.
+	TTL time.Duration
+	// Window is maximal difference between knock timestamp and local
+	// time. Knock nonces are remembered for this long in both directions
+	// to reject replays.
+	Window time.Duration
+	// RateLimit is number of knock datagrams accepted for verification
+	// from a single source address per minute.
+	RateLimit int
+}
+
+type sourceState struct {
+	step      int
+	stepTime  time.Time
+	sequenced time.Time
+	allowed   time.Time
+}
+
+// Gate tracks knocks of source addresses and decides which of them are
+// allowed.
+type Gate struct {
+	cfg     GateConfig
+	limiter rlzone.Ratelimiter[netip.Addr]
+	mux     sync.Mutex
+	sources map[netip.Addr]*sourceState
+	nonces  map[string]time.Time
+}
+
+// NewGate creates gate. Zero TTL, Window and RateLimit are replaced with
+// defaults.
+func NewGate(cfg GateConfig) *Gate {
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.Window == 0 {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.RateLimit == 0 {
+		cfg.RateLimit = DefaultRateLimit
+	}
+	return &Gate{
+		cfg:     cfg,
+		limiter: rlzone.Must(rlzone.NewSmallest[netip.Addr](time.Minute, uint64(cfg.RateLimit))),
+		sources: make(map[netip.Addr]*sourceState),
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// Allowed reports whether handshakes from addr are allowed.
+func (g *Gate) Allowed(addr netip.Addr) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	s, ok := g.sources[addr]
+	return ok && time.Now().Before(s.allowed)
+}
+
+// Knock handles datagram from addr as knock datagram. Key returns
+// pre-shared key of identity. It returns nil if knock is accepted.
+func (g *Gate) Knock(addr netip.Addr, pkt []byte, key func(identity []byte) ([]byte, error)) error {
+	k, err := g.Check(addr, pkt)
+	if err != nil {
+		return err
+	}
+	return g.Accept(addr, k, key)
+}
+
+// Check does cheap checks of datagram from addr as knock datagram: its
+// format, timestamp, nonce and rate of knocks from addr. Knock passing
+// them has to be verified with Accept. Returned knock doesn't reference
+// pkt.
+func (g *Gate) Check(addr netip.Addr, pkt []byte) (*Knock, error) {
+	if !g.cfg.Authenticated {
+		return nil, ErrMalformed
+	}
+	k, err := Parse(pkt)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if k.Timestamp.Before(now.Add(-g.cfg.Window)) || k.Timestamp.After(now.Add(g.cfg.Window)) {
+		return nil, ErrExpired
+	}
+	g.mux.Lock()
+	_, seen := g.nonces[string(k.Nonce)]
+	g.mux.Unlock()
+	if seen {
+		return nil, ErrReplayed
+	}
+	if !g.limiter.Allow(addr) {
+		return nil, ErrLimited
+	}
+	return Parse(bytes.Clone(pkt))
+}
+
+// Accept verifies knock from addr which passed Check and allows addr if
+// knock is valid. Key returns pre-shared key of identity.
+func (g *Gate) Accept(addr netip.Addr, k *Knock, key func(identity []byte) ([]byte, error)) error {
+	psk, err := key(k.Identity)
+	if err != nil {
+		return fmt.Errorf("can't get key of identity %q: %w", k.Identity, err)
+	}
+	if err := k.Verify(psk); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if _, seen := g.nonces[string(k.Nonce)]; seen {
+		return ErrReplayed
+	}
+	if len(g.nonces) >= maxEntries {
+		g.pruneNonces(now)
+		if len(g.nonces) >= maxEntries {
+			return errors.New("too many knocks")
+		}
+	}
+	g.nonces[string(k.Nonce)] = k.Timestamp.Add(g.cfg.Window)
+	s := g.source(addr)
+	if s == nil {
+		return errors.New("too many knocking sources")
+	}
+	if g.cfg.Sequence > 0 && !now.Before(s.sequenced.Add(g.cfg.TTL)) {
+		return errors.New("knock sequence is not completed")
+	}
+	s.allowed = now.Add(g.cfg.TTL)
+	return nil
+}
+
+// Step handles datagram from addr received on port with index step of
+// knock sequence. It reports whether sequence is completed.
+func (g *Gate) Step(addr netip.Addr, step int) bool {
+	if step < 0 || step >= g.cfg.Sequence {
+		return false
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	s := g.source(addr)
+	if s == nil {
+		return false
+	}
+	now := time.Now()
+	switch {
+	case step == s.step && (step == 0 || now.Before(s.stepTime.Add(g.cfg.Window))):
+		s.step++
+	case step == 0:
+		s.step = 1
+	default:
+		s.step = 0
+		return false
+	}
+	s.stepTime = now
+	if s.step < g.cfg.Sequence {
+		return false
+	}
+	s.step = 0
+	s.sequenced = now
+	if !g.cfg.Authenticated {
+		s.allowed = now.Add(g.cfg.TTL)
+	}
+	return true
+}
+
+// source returns state of addr, creating it if there is room for it.
+func (g *Gate) source(addr netip.Addr) *sourceState {
+	if s, ok := g.sources[addr]; ok {
+		return s
+	}
+	if len(g.sources) >= maxEntries {
+		g.pruneSources(time.Now())
+		if len(g.sources) >= maxEntries {
+			return nil
+		}
+	}
+	s := new(sourceState)
+	g.sources[addr] = s
+	return s
+}
+
+func (g *Gate) pruneSources(now time.Time) {
+	for addr, s := range g.sources {
+		if now.After(s.allowed) && now.After(s.sequenced.Add(g.cfg.TTL)) && now.After(s.stepTime.Add(g.cfg.Window)) {
+			delete(g.sources, addr)
+		}
+	}
+}
+
+func (g *Gate) pruneNonces(now time.Time) {
+	for nonce, expires := range g.nonces {
+		if now.After(expires) {
+			delete(g.nonces, nonce)
+		}
+	}
+}
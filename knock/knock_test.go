@@ -0,0 +1,138 @@
+package knock
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestKnock(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	pkt, err := New([]byte("alice"), psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Parse(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k.Identity, []byte("alice")) {
+		t.Errorf("unexpected identity %q", k.Identity)
+	}
+	if d := time.Since(k.Timestamp); d < -time.Second || d > time.Second {
+		t.Errorf("unexpected timestamp %v", k.Timestamp)
+	}
+	if err := k.Verify(psk); err != nil {
+		t.Errorf("verification failed: %v", err)
+	}
+	if err := k.Verify([]byte("wrong")); !errors.Is(err, ErrBadMAC) {
+		t.Errorf("knock is verified with wrong key: %v", err)
+	}
+	pkt[len(pkt)-1] ^= 1
+	if err := k.Verify(psk); !errors.Is(err, ErrBadMAC) {
+		t.Errorf("corrupted knock is verified: %v", err)
+	}
+	if _, err := Parse(pkt[:MinSize-1]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("short knock is parsed: %v", err)
+	}
+}
+
+func TestGateAuthenticated(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	key := func(identity []byte) ([]byte, error) {
+		if string(identity) != "alice" {
+			return nil, errors.New("unknown identity")
+		}
+		return psk, nil
+	}
+	gate := NewGate(GateConfig{Authenticated: true, TTL: 100 * time.Millisecond})
+	addr := netip.MustParseAddr("192.0.2.1")
+	if gate.Allowed(addr) {
+		t.Fatal("source is allowed without knock")
+	}
+	forged, _ := New([]byte("alice"), []byte("wrong"))
+	if err := gate.Knock(addr, forged, key); err == nil {
+		t.Fatal("forged knock is accepted")
+	}
+	unknown, _ := New([]byte("bob"), psk)
+	if err := gate.Knock(addr, unknown, key); err == nil {
+		t.Fatal("knock of unknown identity is accepted")
+	}
+	pkt, _ := New([]byte("alice"), psk)
+	if err := gate.Knock(addr, pkt, key); err != nil {
+		t.Fatalf("knock is rejected: %v", err)
+	}
+	if !gate.Allowed(addr) {
+		t.Fatal("source is not allowed after knock")
+	}
+	if gate.Allowed(netip.MustParseAddr("192.0.2.2")) {
+		t.Fatal("other source is allowed")
+	}
+	if err := gate.Knock(addr, pkt, key); err == nil {
+		t.Fatal("replayed knock is accepted")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if gate.Allowed(addr) {
+		t.Fatal("source is allowed after TTL")
+	}
+}
+
+func TestGateSequence(t *testing.T) {
+	gate := NewGate(GateConfig{Sequence: 3})
+	addr := netip.MustParseAddr("192.0.2.1")
+	for _, step := range []int{0, 2, 1} {
+		gate.Step(addr, step)
+	}
+	if gate.Allowed(addr) {
+		t.Fatal("source is allowed after wrong sequence")
+	}
+	for _, step := range []int{0, 0, 1, 2} {
+		gate.Step(addr, step)
+	}
+	if !gate.Allowed(addr) {
+		t.Fatal("source is not allowed after sequence")
+	}
+
+	psk := []byte("0123456789abcdef")
+	key := func([]byte) ([]byte, error) { return psk, nil }
+	gate = NewGate(GateConfig{Authenticated: true, Sequence: 2})
+	pkt, _ := New(nil, psk)
+	if err := gate.Knock(addr, pkt, key); err == nil {
+		t.Fatal("knock is accepted before sequence")
+	}
+	gate.Step(addr, 0)
+	if !gate.Step(addr, 1) {
+		t.Fatal("sequence is not completed")
+	}
+	if gate.Allowed(addr) {
+		t.Fatal("source is allowed without knock datagram")
+	}
+	pkt, _ = New(nil, psk)
+	if err := gate.Knock(addr, pkt, key); err != nil {
+		t.Fatalf("knock is rejected: %v", err)
+	}
+	if !gate.Allowed(addr) {
+		t.Fatal("source is not allowed after knock")
+	}
+}
+
+func TestGateRateLimit(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	gate := NewGate(GateConfig{Authenticated: true, RateLimit: 2})
+	addr := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		pkt, _ := New([]byte("alice"), psk)
+		if _, err := gate.Check(addr, pkt); err != nil {
+			t.Fatalf("knock is rejected: %v", err)
+		}
+	}
+	pkt, _ := New([]byte("alice"), psk)
+	if _, err := gate.Check(addr, pkt); !errors.Is(err, ErrLimited) {
+		t.Fatalf("knock over rate limit is not rejected: %v", err)
+	}
+	if _, err := gate.Check(netip.MustParseAddr("192.0.2.2"), pkt); err != nil {
+		t.Fatalf("knock of other source is rejected: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package metrics
+
+var (
+	ActiveSessions = NewGaugeVec(
+		"dtlspipe_active_sessions",
+		"Number of currently active sessions.",
+		"role",
+	)
+	Handshakes = NewCounterVec(
+		"dtlspipe_handshakes_total",
+		"Number of DTLS handshakes by result and failure reason.",
+		"role", "result", "reason",
+	)
+	RateLimitRejections = NewCounterVec(
+		"dtlspipe_ratelimit_rejections_total",
+		"Number of incoming connections rejected by rate limiter.",
+		"role",
+	)
+	Bytes = NewCounterVec(
+		"dtlspipe_bytes_total",
+		"Number of forwarded payload bytes. Direction upstream is from client application towards server's remote address.",
+		"role", "direction",
+	)
+	Packets = NewCounterVec(
+		"dtlspipe_packets_total",
+		"Number of forwarded datagrams. Direction upstream is from client application towards server's remote address.",
+		"role", "direction",
+	)
+	StaleDrops = NewCounterVec(
+		"dtlspipe_stale_drops_total",
+		"Number of sessions dropped due to inactivity by stale mode.",
+		"role", "stale_mode",
+	)
+	DialFailures = NewCounterVec(
+		"dtlspipe_dial_failures_total",
+		"Number of failed dial attempts by stage.",
+		"role", "stage",
+	)
+	SessionResumptions = NewCounterVec(
+		"dtlspipe_session_resumptions_total",
+		"Number of session cache lookups for DTLS session resumption by result. Hit on server means resumed session. Rejected counts client sessions declined by server.",
+		"role", "result",
+	)
+	Keepalives = NewCounterVec(
+		"dtlspipe_keepalives_total",
+		"Number of keepalive datagrams sent by client and discarded by server.",
+		"role",
+	)
+	ChaffDatagrams = NewCounterVec(
+		"dtlspipe_chaff_datagrams_total",
+		"Number of chaff datagrams sent and received by direction.",
+		"role", "direction",
+	)
+	ChaffBytes = NewCounterVec(
+		"dtlspipe_chaff_bytes_total",
+		"Number of chaff bytes sent and received by direction.",
+		"role", "direction",
+	)
+	Knocks = NewCounterVec(
+		"dtlspipe_knocks_total",
+		"Number of knocks received by server by kind and result.",
+		"kind", "result",
+	)
+)
@@ -0,0 +1,255 @@
+// Package metrics implements minimal set of Prometheus-compatible
+// metric types and text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	c.v.Add(n)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.v.Load()
+}
+
+func (c *Counter) format() string {
+	return strconv.FormatUint(c.Value(), 10)
+}
+
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Add(n int64) {
+	if g == nil {
+		return
+	}
+	g.v.Add(n)
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Set(n int64) {
+	if g == nil {
+		return
+	}
+	g.v.Store(n)
+}
+
+func (g *Gauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return g.v.Load()
+}
+
+func (g *Gauge) format() string {
+	return strconv.FormatInt(g.Value(), 10)
+}
+
+type metric interface {
+	format() string
+}
+
+type series struct {
+	values []string
+	metric metric
+}
+
+type family struct {
+	name     string
+	help     string
+	typ      string
+	labels   []string
+	newFn    func() metric
+	mux      sync.Mutex
+	children map[string]*series
+}
+
+func (f *family) with(values []string) metric {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if s, ok := f.children[key]; ok {
+		return s.metric
+	}
+	s := &series{
+		values: slices.Clone(values),
+		metric: f.newFn(),
+	}
+	f.children[key] = s
+	return s.metric
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mux.Lock()
+	children := make([]*series, 0, len(f.children))
+	for _, s := range f.children {
+		children = append(children, s)
+	}
+	f.mux.Unlock()
+	if len(children) == 0 {
+		return
+	}
+	slices.SortFunc(children, func(a, b *series) int {
+		return slices.Compare(a.values, b.values)
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, s := range children {
+		w.WriteString(f.name)
+		if len(f.labels) > 0 {
+			w.WriteByte('{')
+			for i, label := range f.labels {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabelValue(s.values[i]))
+			}
+			w.WriteByte('}')
+		}
+		w.WriteByte(' ')
+		w.WriteString(s.metric.format())
+		w.WriteByte('\n')
+	}
+}
+
+type Registry struct {
+	mux      sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+var defaultRegistry = NewRegistry()
+
+func (r *Registry) register(f *family) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, existing := range r.families {
+		if existing.name == f.name {
+			panic(fmt.Sprintf("metric %s registered twice", f.name))
+		}
+	}
+	r.families = append(r.families, f)
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.mux.Lock()
+	families := slices.Clone(r.families)
+	r.mux.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+func Handler() http.Handler {
+	return defaultRegistry.Handler()
+}
+
+type CounterVec struct {
+	f *family
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	f := &family{
+		name:     name,
+		help:     help,
+		typ:      "counter",
+		labels:   labels,
+		newFn:    func() metric { return new(Counter) },
+		children: make(map[string]*series),
+	}
+	r.register(f)
+	return &CounterVec{f}
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return defaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	f := &family{
+		name:     name,
+		help:     help,
+		typ:      "gauge",
+		labels:   labels,
+		newFn:    func() metric { return new(Gauge) },
+		children: make(map[string]*series),
+	}
+	r.register(f)
+	return &GaugeVec{f}
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return defaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.with(values).(*Gauge)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Test counter.", "kind")
+	g := r.NewGaugeVec("test_gauge", "Test \"gauge\".\nSecond line.")
+	r.NewCounterVec("unused_total", "Never used counter.")
+
+	c.With("b").Add(3)
+	c.With("a\"x").Inc()
+	c.With("b").Inc()
+	g.With().Set(-5)
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a\"x"} 1
+test_total{kind="b"} 4
+# HELP test_gauge Test "gauge".\nSecond line.
+# TYPE test_gauge gauge
+test_gauge -5
+`
+	if b.String() != expected {
+		t.Errorf("unexpected exposition:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var c *Counter
+	c.Inc()
+	if c.Value() != 0 {
+		t.Errorf("unexpected nil counter value")
+	}
+	var g *Gauge
+	g.Inc()
+	if g.Value() != 0 {
+		t.Errorf("unexpected nil gauge value")
+	}
+}
@@ -0,0 +1,250 @@
+// Package padding implements framing layer which pads datagrams to sizes
+// drawn from configurable distribution, so sizes of DTLS records don't
+// reveal sizes of tunneled datagrams.
+package padding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/SenseUnit/dtlspipe/randpool"
+	"github.com/pion/dtls/v3"
+)
+
+// Protocol is ALPN protocol name of padded connections without other
+// protocol features.
+const Protocol = "dtlspipe-pad/1"
+
+const (
+	protocolSuffix = "+pad"
+
+	// headerLen is length of frame header holding payload length.
+	headerLen = 2
+
+	// recordOverhead is upper estimate of DTLS record overhead: header,
+	// connection ID, IV or explicit nonce, MAC or authentication tag and
+	// CBC padding.
+	recordOverhead = 96
+
+	// defaultMTU is MTU used by DTLS library when it's not specified.
+	defaultMTU = 1200
+
+	maxPktBuf = 65536
+)
+
+// ProtocolFor returns ALPN protocol name of padded variant of protocol.
+func ProtocolFor(protocol string) string {
+	if protocol == "" {
+		return Protocol
+	}
+	return protocol + protocolSuffix
+}
+
+// SplitProtocol returns protocol without padding and reports whether
+// protocol is padded variant.
+func SplitProtocol(protocol string) (string, bool) {
+	if protocol == Protocol {
+		return "", true
+	}
+	if base, ok := strings.CutSuffix(protocol, protocolSuffix); ok {
+		return base, true
+	}
+	return protocol, false
+}
+
+// MaxSize returns size datagrams can be padded to without exceeding MTU
+// of DTLS connection.
+func MaxSize(mtu int) int {
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	return max(mtu-recordOverhead, headerLen)
+}
+
+// Distribution chooses size of padded datagram.
+type Distribution interface {
+	// Size returns size datagram of length n is padded to. Result is
+	// between n and limit, unless n already exceeds limit.
+	Size(n, limit int) int
+}
+
+type uniform struct {
+	max int
+}
+
+func (d uniform) Size(n, limit int) int {
+	room := limit - n
+	if d.max > 0 {
+		room = min(room, d.max)
+	}
+	if room <= 0 {
+		return n
+	}
+	var pad int
+	randpool.Borrow(func(r *rand.Rand) {
+		pad = r.Intn(room + 1)
+	})
+	return n + pad
+}
+
+type exponential struct {
+	mean float64
+}
+
+func (d exponential) Size(n, limit int) int {
+	if n >= limit {
+		return n
+	}
+	var pad float64
+	randpool.Borrow(func(r *rand.Rand) {
+		pad = r.ExpFloat64() * d.mean
+	})
+	return n + int(min(pad, float64(limit-n)))
+}
+
+type buckets []int
+
+func (d buckets) Size(n, limit int) int {
+	if n >= limit {
+		return n
+	}
+	for _, size := range d {
+		if size >= n {
+			return min(size, limit)
+		}
+	}
+	return limit
+}
+
+type full struct{}
+
+func (full) Size(n, limit int) int {
+	return max(n, limit)
+}
+
+// Default is distribution used when none is specified.
+var Default Distribution = uniform{}
+
+// ParseDistribution parses distribution spec. Supported specs:
+//
+//	uniform[:MAX]     random padding of up to MAX bytes, up to size limit by default
+//	exp:MEAN          random padding with exponential distribution
+//	bucket:S1,S2,...  pad to the smallest of listed sizes
+//	max               pad to size limit
+func ParseDistribution(spec string) (Distribution, error) {
+	kind, arg, hasArg := strings.Cut(spec, ":")
+	switch kind {
+	case "uniform":
+		if !hasArg {
+			return uniform{}, nil
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad uniform padding limit %q", arg)
+		}
+		return uniform{max: n}, nil
+	case "exp":
+		mean, err := strconv.ParseFloat(arg, 64)
+		if err != nil || !(mean > 0) || math.IsInf(mean, 0) {
+			return nil, fmt.Errorf("bad exponential padding mean %q", arg)
+		}
+		return exponential{mean: mean}, nil
+	case "bucket":
+		var sizes buckets
+		for _, field := range strings.Split(arg, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("bad bucket size %q", field)
+			}
+			sizes = append(sizes, size)
+		}
+		slices.Sort(sizes)
+		return sizes, nil
+	case "max":
+		if hasArg {
+			return nil, errors.New("max padding doesn't take arguments")
+		}
+		return full{}, nil
+	}
+	return nil, fmt.Errorf("unknown padding distribution %q", kind)
+}
+
+// Conn pads datagrams written to underlying connection and strips padding
+// from datagrams read from it. Each datagram is prefixed with length of
+// payload.
+type Conn struct {
+	net.Conn
+	dist  Distribution
+	limit int
+
+	readMux sync.Mutex
+	readBuf []byte
+}
+
+// NewConn wraps conn. Datagrams are padded to sizes chosen by dist, which
+// don't exceed limit.
+func NewConn(conn net.Conn, dist Distribution, limit int) *Conn {
+	return &Conn{
+		Conn:    conn,
+		dist:    dist,
+		limit:   limit,
+		readBuf: make([]byte, maxPktBuf),
+	}
+}
+
+// Read reads datagram payload. Malformed frames are skipped.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMux.Lock()
+	defer c.readMux.Unlock()
+	for {
+		n, err := c.Conn.Read(c.readBuf)
+		if err != nil {
+			return 0, err
+		}
+		if n < headerLen {
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(c.readBuf))
+		if headerLen+length > n {
+			continue
+		}
+		return copy(b, c.readBuf[headerLen:headerLen+length]), nil
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if len(b) > math.MaxUint16 {
+		return 0, errors.New("datagram is too big")
+	}
+	size := max(c.dist.Size(headerLen+len(b), c.limit), headerLen+len(b))
+	frame := make([]byte, size)
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[headerLen:], b)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ConnectionState returns state of underlying DTLS connection with
+// padding removed from negotiated protocol, so upper layers see protocol
+// they handle.
+func (c *Conn) ConnectionState() (dtls.State, bool) {
+	stater, ok := c.Conn.(interface {
+		ConnectionState() (dtls.State, bool)
+	})
+	if !ok {
+		return dtls.State{}, false
+	}
+	state, ok := stater.ConnectionState()
+	state.NegotiatedProtocol, _ = SplitProtocol(state.NegotiatedProtocol)
+	return state, ok
+}
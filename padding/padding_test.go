@@ -0,0 +1,84 @@
+package padding
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestDistributions(t *testing.T) {
+	for _, spec := range []string{"uniform", "uniform:100", "exp:50", "bucket:512,128,256", "max"} {
+		dist, err := ParseDistribution(spec)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", spec, err)
+		}
+		for i := 0; i < 100; i++ {
+			if size := dist.Size(100, 1000); size < 100 || size > 1000 {
+				t.Errorf("%s: size %d is out of range", spec, size)
+			}
+			if size := dist.Size(1500, 1000); size != 1500 {
+				t.Errorf("%s: oversized datagram is padded to %d", spec, size)
+			}
+		}
+	}
+	dist, _ := ParseDistribution("bucket:512,128,256")
+	for n, expected := range map[int]int{1: 128, 128: 128, 129: 256, 400: 512, 600: 1000} {
+		if size := dist.Size(n, 1000); size != expected {
+			t.Errorf("bucket size for %d: expected %d, got %d", n, expected, size)
+		}
+	}
+	dist, _ = ParseDistribution("uniform:100")
+	for i := 0; i < 100; i++ {
+		if size := dist.Size(10, 1000); size > 110 {
+			t.Fatalf("padding exceeds limit: %d", size)
+		}
+	}
+	for _, spec := range []string{"", "gauss", "uniform:x", "exp:0", "bucket:", "bucket:1,x", "max:1"} {
+		if _, err := ParseDistribution(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	left, right := net.Pipe()
+	dist, _ := ParseDistribution("max")
+	sender := NewConn(left, dist, 300)
+	defer sender.Close()
+	receiver := NewConn(right, dist, 300)
+	defer receiver.Close()
+
+	go func() {
+		sender.Write([]byte("hello"))
+		// malformed frame is skipped
+		left.Write([]byte{0xff, 0xff, 1})
+		sender.Write([]byte{})
+		sender.Write(bytes.Repeat([]byte("x"), 500))
+	}()
+	buf := make([]byte, 1000)
+	if n, err := receiver.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+	if n, err := receiver.Read(buf); err != nil || n != 0 {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+	if n, err := receiver.Read(buf); err != nil || n != 500 {
+		t.Fatalf("unexpected read length %d: %v", n, err)
+	}
+
+	go receiver.Write([]byte("padded"))
+	n, err := left.Read(buf)
+	if err != nil || n != 300 {
+		t.Fatalf("datagram is not padded: %d, %v", n, err)
+	}
+
+	if base, padded := SplitProtocol(ProtocolFor("")); base != "" || !padded {
+		t.Errorf("unexpected split: %q, %v", base, padded)
+	}
+	if base, padded := SplitProtocol(ProtocolFor("dtlspipe-mux/1")); base != "dtlspipe-mux/1" || !padded {
+		t.Errorf("unexpected split: %q, %v", base, padded)
+	}
+	if base, padded := SplitProtocol("dtlspipe-mux/1"); base != "dtlspipe-mux/1" || padded {
+		t.Errorf("unexpected split: %q, %v", base, padded)
+	}
+}
@@ -0,0 +1,251 @@
+// Package resumption implements DTLS session store for session
+// resumption.
+package resumption
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/util"
+	"github.com/pion/dtls/v3"
+)
+
+type entry struct {
+	Key     []byte    `json:"key"`
+	ID      []byte    `json:"id"`
+	Secret  []byte    `json:"secret"`
+	Tag     string    `json:"tag,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Cache is in-memory DTLS session store with limited size and session
+// lifetime. Optionally it's persisted to file.
+type Cache struct {
+	role    string
+	ttl     time.Duration
+	size    int
+	path    string
+	logger  *slog.Logger
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	saveMux sync.Mutex
+}
+
+// NewCache creates cache holding at most size sessions for ttl. Role is
+// used as label of metrics.
+func NewCache(role string, ttl time.Duration, size int) *Cache {
+	return &Cache{
+		role:    role,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// NewFileCache creates cache which is loaded from file and saved to it on
+// every change. Missing file is treated as empty cache. Save errors are
+// reported to logger.
+func NewFileCache(role string, path string, ttl time.Duration, size int, logger *slog.Logger) (*Cache, error) {
+	c := NewCache(role, ttl, size)
+	c.path = path
+	c.logger = logger
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("can't read session cache file: %w", err)
+	}
+	var entries []*entry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("can't parse session cache file %q: %w", path, err)
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if now.Before(e.Expires) {
+			c.putLocked(e)
+		}
+	}
+	return c, nil
+}
+
+func (c *Cache) Set(key []byte, s dtls.Session) error {
+	if len(s.ID) == 0 {
+		return nil
+	}
+	c.mux.Lock()
+	c.putLocked(&entry{
+		Key:     bytes.Clone(key),
+		ID:      bytes.Clone(s.ID),
+		Secret:  bytes.Clone(s.Secret),
+		Expires: time.Now().Add(c.ttl),
+	})
+	c.mux.Unlock()
+	c.trySave()
+	return nil
+}
+
+func (c *Cache) putLocked(e *entry) {
+	if el, ok := c.entries[string(e.Key)]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[string(e.Key)] = c.order.PushBack(e)
+	for c.order.Len() > c.size {
+		c.removeLocked(c.order.Front())
+	}
+}
+
+func (c *Cache) removeLocked(el *list.Element) {
+	e := c.order.Remove(el).(*entry)
+	delete(c.entries, string(e.Key))
+	clear(e.Secret)
+}
+
+func (c *Cache) lookupLocked(key []byte) *entry {
+	el, ok := c.entries[string(key)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*entry)
+	if !time.Now().Before(e.Expires) {
+		c.removeLocked(el)
+		return nil
+	}
+	return e
+}
+
+func (c *Cache) Get(key []byte) (dtls.Session, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e := c.lookupLocked(key)
+	if e == nil {
+		metrics.SessionResumptions.With(c.role, "miss").Inc()
+		return dtls.Session{}, nil
+	}
+	metrics.SessionResumptions.With(c.role, "hit").Inc()
+	return dtls.Session{
+		ID:     bytes.Clone(e.ID),
+		Secret: bytes.Clone(e.Secret),
+	}, nil
+}
+
+// Del removes session by key. Client side calls it with ID of session
+// rejected by server, so sessions with such ID are removed as well.
+func (c *Cache) Del(key []byte) error {
+	c.mux.Lock()
+	removed := false
+	if el, ok := c.entries[string(key)]; ok {
+		c.removeLocked(el)
+		removed = true
+	} else {
+		for el := c.order.Front(); el != nil; {
+			next := el.Next()
+			if bytes.Equal(el.Value.(*entry).ID, key) {
+				c.removeLocked(el)
+				removed = true
+			}
+			el = next
+		}
+		if removed {
+			metrics.SessionResumptions.With(c.role, "rejected").Inc()
+		}
+	}
+	c.mux.Unlock()
+	if removed {
+		c.trySave()
+	}
+	return nil
+}
+
+// SetTag associates tag with stored session. Server uses it to remember
+// client identity which isn't available on resumed connections.
+func (c *Cache) SetTag(key []byte, tag string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e := c.lookupLocked(key); e != nil {
+		e.Tag = tag
+	}
+}
+
+// Tag returns tag associated with stored session.
+func (c *Cache) Tag(key []byte) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e := c.lookupLocked(key); e != nil && e.Tag != "" {
+		return e.Tag, true
+	}
+	return "", false
+}
+
+// Clear removes all sessions, so next connections perform full handshake.
+func (c *Cache) Clear() error {
+	c.mux.Lock()
+	for c.order.Len() > 0 {
+		c.removeLocked(c.order.Front())
+	}
+	c.mux.Unlock()
+	return c.save()
+}
+
+// Len returns number of stored sessions.
+func (c *Cache) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.order.Len()
+}
+
+// trySave saves cache reporting error to logger. Failure to persist
+// cache shouldn't fail handshake.
+func (c *Cache) trySave() {
+	if err := c.save(); err != nil {
+		c.logger.Warn("session cache save failed", util.ErrorAttrs(err)...)
+	}
+}
+
+func (c *Cache) save() error {
+	if c.path == "" {
+		return nil
+	}
+	c.saveMux.Lock()
+	defer c.saveMux.Unlock()
+
+	c.mux.Lock()
+	entries := make([]*entry, 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		e := *el.Value.(*entry)
+		entries = append(entries, &e)
+	}
+	content, err := json.Marshal(entries)
+	c.mux.Unlock()
+	if err != nil {
+		return fmt.Errorf("can't marshal session cache: %w", err)
+	}
+	defer clear(content)
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("can't save session cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't save session cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can't save session cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("can't save session cache: %w", err)
+	}
+	return nil
+}
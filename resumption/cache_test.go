@@ -0,0 +1,94 @@
+package resumption
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+func session(id string) dtls.Session {
+	return dtls.Session{ID: []byte(id), Secret: []byte("secret-" + id)}
+}
+
+func TestCacheLimits(t *testing.T) {
+	c := NewCache("test", time.Hour, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set([]byte(key), session(key))
+	}
+	if n := c.Len(); n != 2 {
+		t.Fatalf("unexpected cache size: %d", n)
+	}
+	if s, _ := c.Get([]byte("a")); s.ID != nil {
+		t.Error("oldest session is not evicted")
+	}
+	if s, _ := c.Get([]byte("c")); !bytes.Equal(s.Secret, []byte("secret-c")) {
+		t.Errorf("unexpected session secret %q", s.Secret)
+	}
+
+	c = NewCache("test", 50*time.Millisecond, 2)
+	c.Set([]byte("a"), session("a"))
+	time.Sleep(100 * time.Millisecond)
+	if s, _ := c.Get([]byte("a")); s.ID != nil {
+		t.Error("expired session is returned")
+	}
+}
+
+func TestCacheDel(t *testing.T) {
+	c := NewCache("test", time.Hour, 10)
+	c.Set([]byte("server1"), session("id1"))
+	c.Set([]byte("server2"), session("id2"))
+	c.Del([]byte("server1"))
+	c.Del([]byte("id2"))
+	if n := c.Len(); n != 0 {
+		t.Fatalf("sessions are not deleted: %d left", n)
+	}
+}
+
+func TestCacheTag(t *testing.T) {
+	c := NewCache("test", time.Hour, 10)
+	c.SetTag([]byte("id"), "missing")
+	if _, ok := c.Tag([]byte("id")); ok {
+		t.Error("tag set for missing session")
+	}
+	c.Set([]byte("id"), session("id"))
+	c.SetTag([]byte("id"), "alice")
+	if tag, ok := c.Tag([]byte("id")); !ok || tag != "alice" {
+		t.Errorf("unexpected tag %q", tag)
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	c, err := NewFileCache("test", path, time.Hour, 10, nil)
+	if err != nil {
+		t.Fatalf("can't create cache: %v", err)
+	}
+	c.Set([]byte("server1"), session("id1"))
+	c.Set([]byte("server2"), session("id2"))
+	c.Del([]byte("server2"))
+
+	c, err = NewFileCache("test", path, time.Hour, 10, nil)
+	if err != nil {
+		t.Fatalf("can't load cache: %v", err)
+	}
+	if n := c.Len(); n != 1 {
+		t.Fatalf("unexpected number of loaded sessions: %d", n)
+	}
+	if s, _ := c.Get([]byte("server1")); !bytes.Equal(s.ID, []byte("id1")) {
+		t.Errorf("unexpected session ID %q", s.ID)
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatalf("clear failed: %v", err)
+	}
+	c, err = NewFileCache("test", path, time.Hour, 10, nil)
+	if err != nil {
+		t.Fatalf("can't load cache: %v", err)
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("cleared cache has %d sessions", n)
+	}
+}
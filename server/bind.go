@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/SenseUnit/dtlspipe/addrgen"
+)
+
+// MaxBindAddresses limits number of addresses bind specification may
+// expand to, since server opens socket for each of them.
+const MaxBindAddresses = 4096
+
+// ParseBindSpec expands bind specification into the list of addresses
+// to listen on. Specification consists of one or more comma-separated IP
+// addresses (IPv6 addresses in square brackets) followed by colon and
+// one or more comma-separated ports or port ranges, e.g.
+// "0.0.0.0,[::]:20000-20100,30000".
+func ParseBindSpec(spec string) ([]netip.AddrPort, error) {
+	lastColonIdx := strings.LastIndex(spec, ":")
+	if lastColonIdx == -1 {
+		return nil, errors.New("port specification not found - colon is missing")
+	}
+
+	var ports []uint16
+	for _, portSpec := range strings.Split(spec[lastColonIdx+1:], ",") {
+		portRange, err := addrgen.ParsePortRangeSpec(portSpec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse port part: %w", err)
+		}
+		ports = append(ports, portRange.Ports()...)
+	}
+
+	var res []netip.AddrPort
+	seen := make(map[netip.AddrPort]struct{})
+	for _, addrSpec := range strings.Split(spec[:lastColonIdx], ",") {
+		addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(addrSpec, "["), "]"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse bind address %q: %w", addrSpec, err)
+		}
+		for _, port := range ports {
+			addrPort := netip.AddrPortFrom(addr, port)
+			if _, ok := seen[addrPort]; ok {
+				continue
+			}
+			if len(res) >= MaxBindAddresses {
+				return nil, fmt.Errorf("bind address expands to more than %d addresses", MaxBindAddresses)
+			}
+			seen[addrPort] = struct{}{}
+			res = append(res, addrPort)
+		}
+	}
+	return res, nil
+}
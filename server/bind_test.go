@@ -0,0 +1,39 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseBindSpec(t *testing.T) {
+	testCases := []struct {
+		spec string
+		want []string
+	}{
+		{"127.0.0.1:5000", []string{"127.0.0.1:5000"}},
+		{"[::1]:5000-5002", []string{"[::1]:5000", "[::1]:5001", "[::1]:5002"}},
+		{"127.0.0.1,[::1]:5000,5000-5001", []string{"127.0.0.1:5000", "127.0.0.1:5001", "[::1]:5000", "[::1]:5001"}},
+	}
+	for _, tc := range testCases {
+		addrs, err := ParseBindSpec(tc.spec)
+		if err != nil {
+			t.Errorf("spec %q: unexpected error: %v", tc.spec, err)
+			continue
+		}
+		got := make([]string, 0, len(addrs))
+		for _, a := range addrs {
+			got = append(got, a.String())
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("spec %q: got %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParseBindSpecErrors(t *testing.T) {
+	for _, spec := range []string{"127.0.0.1", "localhost:5000", "127.0.0.1:x", "127.0.0.1:1-2-3", ":5000", "0.0.0.0:20000-50000", "127.0.0.1,[::1]:10000-13000"} {
+		if _, err := ParseBindSpec(spec); err == nil {
+			t.Errorf("spec %q: expected error", spec)
+		}
+	}
+}
@@ -2,20 +2,31 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
 	"net"
 	"time"
 
+	"github.com/SenseUnit/dtlspipe/chaff"
 	"github.com/SenseUnit/dtlspipe/ciphers"
+	"github.com/SenseUnit/dtlspipe/padding"
+	"github.com/SenseUnit/dtlspipe/resumption"
+	"github.com/SenseUnit/dtlspipe/session"
 	"github.com/SenseUnit/dtlspipe/util"
 )
 
 type Config struct {
 	BindAddress     string
 	RemoteAddress   string
+	Routes          map[string]string
 	Timeout         time.Duration
 	IdleTimeout     time.Duration
 	BaseContext     context.Context
 	PSKCallback     func([]byte) ([]byte, error)
+	Certificates    []tls.Certificate
+	ClientCAs       *x509.CertPool
+	PeerKeys        map[string]string
 	MTU             int
 	SkipHelloVerify bool
 	CipherSuites    ciphers.CipherList
@@ -24,6 +35,19 @@ type Config struct {
 	TimeLimitFunc   func() time.Duration
 	AllowFunc       func(net.Addr) bool
 	EnableCID       bool
+	SessionCache    *resumption.Cache
+	UpstreamGrace   time.Duration
+	Padding         padding.Distribution
+	Chaff           chaff.Schedule
+	ChaffBudget     int
+	AcceptProfiles  bool
+	Knock           bool
+	KnockPorts      []uint16
+	KnockTTL        time.Duration
+	Sessions        *session.Registry
+	ProxyProtocol   ProxyProtocolMode
+	ProxyIdentity   bool
+	Logger          *slog.Logger
 }
 
 func (cfg *Config) populateDefaults() *Config {
@@ -38,6 +62,15 @@ func (cfg *Config) populateDefaults() *Config {
 	}
 	if cfg.CipherSuites == nil {
 		cfg.CipherSuites = ciphers.DefaultCipherList
+		if len(cfg.Certificates) > 0 {
+			cfg.CipherSuites = ciphers.DefaultCertCipherList
+		}
+	}
+	if cfg.ChaffBudget == 0 {
+		cfg.ChaffBudget = chaff.DefaultBudget
+	}
+	if cfg.Padding == nil {
+		cfg.Padding = padding.Default
 	}
 	if cfg.EllipticCurves == nil {
 		cfg.EllipticCurves = ciphers.DefaultCurveList
@@ -48,5 +81,11 @@ func (cfg *Config) populateDefaults() *Config {
 	if cfg.AllowFunc == nil {
 		cfg.AllowFunc = util.AllowAllFunc
 	}
+	if cfg.Sessions == nil {
+		cfg.Sessions = session.NewRegistry()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
 	return cfg
 }
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net"
+
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+// keepaliveFilter discards keepalive datagrams sent by client on
+// connections which negotiated keepalives. Keepalives are consumed within
+// the same read call, so they neither extend read deadline nor count as
+// session activity.
+type keepaliveFilter struct {
+	net.Conn
+}
+
+func (c keepaliveFilter) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil || !util.IsKeepalive(b[:n]) {
+			return n, err
+		}
+		metrics.Keepalives.With("server").Inc()
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+func TestKeepaliveFilter(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := keepaliveFilter{local}
+	defer conn.Close()
+
+	go func() {
+		remote.Write(util.KeepaliveDatagram)
+		remote.Write(util.KeepaliveDatagram)
+		remote.Write([]byte("data"))
+	}()
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/SenseUnit/dtlspipe/knock"
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+// knockListener receives datagrams of knock sequence. Datagram received
+// on i-th knock port advances sequence of its source address to step i.
+// Server never replies on knock ports.
+type knockListener struct {
+	sockets []*net.UDPConn
+	wg      sync.WaitGroup
+}
+
+// listenKnock listens knock ports on addresses of bind address.
+func listenKnock(bind []netip.AddrPort, ports []uint16, gate *knock.Gate) (*knockListener, error) {
+	var addrs []netip.Addr
+	for _, addrPort := range bind {
+		if !slices.Contains(addrs, addrPort.Addr()) {
+			addrs = append(addrs, addrPort.Addr())
+		}
+	}
+	l := new(knockListener)
+	for step, port := range ports {
+		for _, addr := range addrs {
+			socket, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port)))
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			l.sockets = append(l.sockets, socket)
+			l.wg.Add(1)
+			go l.readLoop(socket, step, gate)
+		}
+	}
+	return l, nil
+}
+
+func (l *knockListener) readLoop(socket *net.UDPConn, step int, gate *knock.Gate) {
+	defer l.wg.Done()
+	buf := make([]byte, receiveMTU)
+	for {
+		_, rAddr, err := socket.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if gate.Step(rAddr.Addr().Unmap(), step) {
+			metrics.Knocks.With("sequence", "accepted").Inc()
+		}
+	}
+}
+
+func (l *knockListener) Close() error {
+	var errs []error
+	for _, socket := range l.sockets {
+		if err := socket.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	l.wg.Wait()
+	return errors.Join(errs...)
+}
+
+const (
+	// knockWorkers bounds number of knock datagrams verified concurrently.
+	knockWorkers = 4
+	// knockQueueLength bounds number of knock datagrams awaiting
+	// verification. Knocks arriving to full queue are dropped.
+	knockQueueLength = 64
+	// maxHeldPackets bounds number of datagrams held for source address
+	// while its knock is verified.
+	maxHeldPackets = 4
+)
+
+type knockJob struct {
+	rAddr netip.AddrPort
+	knock *knock.Knock
+}
+
+type heldPacket struct {
+	socket int
+	rAddr  netip.AddrPort
+	data   []byte
+}
+
+// knockSource is a source address with knocks under verification.
+type knockSource struct {
+	jobs int
+	held []heldPacket
+}
+
+// knockVerifier verifies knock datagrams in background. Key lookup may
+// be slow, e.g. with passphrase or helper program keystore, so it must
+// not stall read loop of listener. Datagrams which arrive from source
+// address while its knock is verified are held and delivered once knock
+// is accepted, so handshake following knock isn't lost.
+type knockVerifier struct {
+	gate    *knock.Gate
+	key     func(identity []byte) ([]byte, error)
+	logger  *slog.Logger
+	queue   chan knockJob
+	mux     sync.Mutex
+	sources map[netip.Addr]*knockSource
+	deliver func(socket int, rAddr netip.AddrPort, pkt []byte)
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func newKnockVerifier(gate *knock.Gate, key func([]byte) ([]byte, error), logger *slog.Logger) *knockVerifier {
+	v := &knockVerifier{
+		gate:    gate,
+		key:     key,
+		logger:  logger,
+		queue:   make(chan knockJob, knockQueueLength),
+		sources: make(map[netip.Addr]*knockSource),
+	}
+	for range knockWorkers {
+		v.wg.Add(1)
+		go v.worker()
+	}
+	return v
+}
+
+// submit queues datagram for verification if it looks like knock. It
+// reports whether datagram was consumed as knock.
+func (v *knockVerifier) submit(rAddr netip.AddrPort, pkt []byte) bool {
+	k, err := v.gate.Check(rAddr.Addr(), pkt)
+	switch {
+	case err == nil:
+	case errors.Is(err, knock.ErrMalformed), errors.Is(err, knock.ErrExpired):
+		// most likely it's not a knock
+		return false
+	default:
+		v.reject(rAddr, err)
+		return true
+	}
+	v.mux.Lock()
+	src, ok := v.sources[rAddr.Addr()]
+	if !ok {
+		src = new(knockSource)
+		v.sources[rAddr.Addr()] = src
+	}
+	src.jobs++
+	v.mux.Unlock()
+	select {
+	case v.queue <- knockJob{rAddr, k}:
+	default:
+		v.done(rAddr.Addr(), false)
+		v.reject(rAddr, errors.New("knock verification queue is full"))
+	}
+	return true
+}
+
+// setDeliver sets function which receives held datagrams of source
+// address once its knock is accepted.
+func (v *knockVerifier) setDeliver(deliver func(int, netip.AddrPort, []byte)) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.deliver = deliver
+}
+
+// hold keeps datagram until knock of its source address is verified if
+// source isn't allowed yet and has knock under verification. It reports
+// whether datagram was consumed.
+func (v *knockVerifier) hold(socket int, rAddr netip.AddrPort, pkt []byte) bool {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	src, ok := v.sources[rAddr.Addr()]
+	if !ok || v.gate.Allowed(rAddr.Addr()) {
+		return false
+	}
+	if len(src.held) < maxHeldPackets {
+		src.held = append(src.held, heldPacket{socket, rAddr, bytes.Clone(pkt)})
+	}
+	return true
+}
+
+// done completes verification of knock from addr. Held datagrams are
+// delivered if knock is accepted and dropped when last knock of source
+// is rejected.
+func (v *knockVerifier) done(addr netip.Addr, accepted bool) {
+	v.mux.Lock()
+	src := v.sources[addr]
+	src.jobs--
+	var held []heldPacket
+	if accepted {
+		held, src.held = src.held, nil
+	}
+	if src.jobs == 0 {
+		delete(v.sources, addr)
+	}
+	deliver := v.deliver
+	v.mux.Unlock()
+	if deliver == nil {
+		return
+	}
+	for _, pkt := range held {
+		deliver(pkt.socket, pkt.rAddr, pkt.data)
+	}
+}
+
+func (v *knockVerifier) worker() {
+	defer v.wg.Done()
+	for job := range v.queue {
+		err := v.gate.Accept(job.rAddr.Addr(), job.knock, v.key)
+		v.done(job.rAddr.Addr(), err == nil)
+		if err != nil {
+			v.reject(job.rAddr, err)
+			continue
+		}
+		metrics.Knocks.With("datagram", "accepted").Inc()
+		v.logger.Debug("knock accepted", util.LogKeyRemoteAddr, job.rAddr.String())
+	}
+}
+
+func (v *knockVerifier) reject(rAddr netip.AddrPort, err error) {
+	metrics.Knocks.With("datagram", "rejected").Inc()
+	v.logger.Debug("knock rejected", append(util.ErrorAttrs(err), util.LogKeyRemoteAddr, rAddr.String())...)
+}
+
+// Close waits for queued knocks to be verified. No knocks may be
+// submitted after Close.
+func (v *knockVerifier) Close() {
+	v.once.Do(func() {
+		close(v.queue)
+	})
+	v.wg.Wait()
+}
+
+// admit lets datagrams of unknown peers through only if their source
+// address is allowed by knock gate. Knock datagrams are consumed, as well
+// as datagrams held until knock verification completes.
+func (srv *Server) admit(socket int, rAddr netip.AddrPort, pkt []byte) bool {
+	if srv.knockVf != nil {
+		if srv.knockVf.submit(rAddr, pkt) || srv.knockVf.hold(socket, rAddr, pkt) {
+			return false
+		}
+	}
+	return srv.gate.Allowed(rAddr.Addr())
+}
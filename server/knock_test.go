@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/knock"
+)
+
+func TestKnockSlowKey(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	release := make(chan struct{})
+	key := func(identity []byte) ([]byte, error) {
+		if string(identity) != "alice" {
+			<-release
+		}
+		return psk, nil
+	}
+	gate := knock.NewGate(knock.GateConfig{Authenticated: true})
+	srv := &Server{
+		gate:    gate,
+		knockVf: newKnockVerifier(gate, key, slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}
+	defer srv.knockVf.Close()
+	defer close(release)
+	l, err := listenMux([]netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:0"),
+	}, 0, srv.admit)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("peer listen failed: %v", err)
+	}
+	defer peer.Close()
+	pkt, _ := knock.New([]byte("alice"), psk)
+	peer.WriteTo(pkt, l.sockets[0].LocalAddr())
+	for deadline := time.Now().Add(time.Second); !gate.Allowed(netip.MustParseAddr("127.0.0.1")); {
+		if time.Now().After(deadline) {
+			t.Fatal("knock is not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	hello := []byte{contentTypeHandshake, 0xfe, 0xfd, 1, 2, 3}
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	// knocks with identities which take forever to look up occupy all
+	// verification workers
+	attacker, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("attacker listen failed: %v", err)
+	}
+	defer attacker.Close()
+	for range knockWorkers + 1 {
+		pkt, _ := knock.New([]byte("mallory"), psk)
+		attacker.WriteTo(pkt, l.sockets[0].LocalAddr())
+	}
+
+	peer.WriteTo([]byte("data"), l.sockets[0].LocalAddr())
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+	}
+	if string(buf[:4]) != "data" {
+		t.Fatalf("unexpected read: %q", buf[:4])
+	}
+}
+
+func TestKnockHoldsHandshake(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	// keystore which is much slower than knock interval of client
+	key := func(identity []byte) ([]byte, error) {
+		time.Sleep(200 * time.Millisecond)
+		if string(identity) != "alice" {
+			return nil, errors.New("unknown identity")
+		}
+		return psk, nil
+	}
+	gate := knock.NewGate(knock.GateConfig{Authenticated: true})
+	srv := &Server{
+		gate:    gate,
+		knockVf: newKnockVerifier(gate, key, slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}
+	defer srv.knockVf.Close()
+	l, err := listenMux([]netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:0"),
+	}, 0, srv.admit)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+	srv.knockVf.setDeliver(l.dispatch)
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("peer listen failed: %v", err)
+	}
+	defer peer.Close()
+
+	// handshake following rejected knock is dropped
+	hello := []byte{contentTypeHandshake, 0xfe, 0xfd, 1, 2, 3}
+	pkt, _ := knock.New([]byte("mallory"), psk)
+	peer.WriteTo(pkt, l.sockets[0].LocalAddr())
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	select {
+	case c := <-l.acceptCh:
+		t.Fatalf("unexpected connection from %s", c.RemoteAddr())
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	// handshake sent right after knock waits for knock verification
+	pkt, _ = knock.New([]byte("alice"), psk)
+	peer.WriteTo(pkt, l.sockets[0].LocalAddr())
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	var conn *muxConn
+	select {
+	case conn = <-l.acceptCh:
+	case <-time.After(time.Second):
+		t.Fatal("handshake is not delivered after knock verification")
+	}
+	defer conn.Close()
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != string(hello) {
+		t.Fatalf("unexpected read: %v, %v", buf[:n], err)
+	}
+}
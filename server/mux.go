@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pion/transport/v3/deadline"
+)
+
+const (
+	receiveMTU      = 8192
+	connQueueLength = 64
+
+	contentTypeHandshake = 22
+	contentTypeCID       = 25
+	// content type, version, epoch and sequence number
+	cidRecordOffset = 1 + 2 + 2 + 6
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+type tupleKey struct {
+	socket int
+	remote netip.AddrPort
+}
+
+// muxListener demultiplexes datagrams received on a set of UDP sockets
+// into per-peer packet connections. Established connections are found by
+// DTLS connection ID regardless of socket and source address datagram
+// came from, so peer may freely move across listening ports.
+type muxListener struct {
+	sockets  []*net.UDPConn
+	cidLen   int
+	admit    func(socket int, rAddr netip.AddrPort, pkt []byte) bool
+	mux      sync.Mutex
+	byTuple  map[tupleKey]*muxConn
+	byCID    map[string]*muxConn
+	acceptCh chan *muxConn
+	closed   chan struct{}
+	closeErr error
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+// listenMux starts listener. Admit, if not nil, is called for datagrams
+// of unknown peers along with index of socket they came from. Datagrams
+// it rejects are dropped.
+func listenMux(addrs []netip.AddrPort, cidLen int, admit func(int, netip.AddrPort, []byte) bool) (*muxListener, error) {
+	l := &muxListener{
+		cidLen:   cidLen,
+		admit:    admit,
+		byTuple:  make(map[tupleKey]*muxConn),
+		byCID:    make(map[string]*muxConn),
+		acceptCh: make(chan *muxConn, Backlog),
+		closed:   make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		socket, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.sockets = append(l.sockets, socket)
+	}
+	for i := range l.sockets {
+		l.wg.Add(1)
+		go l.readLoop(i)
+	}
+	return l, nil
+}
+
+func (l *muxListener) readLoop(idx int) {
+	defer l.wg.Done()
+	socket := l.sockets[idx]
+	buf := make([]byte, receiveMTU)
+	for {
+		n, rAddr, err := socket.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		l.dispatch(idx, netip.AddrPortFrom(rAddr.Addr().Unmap(), rAddr.Port()), buf[:n])
+	}
+}
+
+func (l *muxListener) dispatch(idx int, rAddr netip.AddrPort, pkt []byte) {
+	// admission check may be slow, so it's done outside of lock and only
+	// for datagrams which don't belong to known peers
+	if l.admit != nil {
+		l.mux.Lock()
+		known := l.known(idx, rAddr, pkt)
+		l.mux.Unlock()
+		if !known && !l.admit(idx, rAddr, pkt) {
+			return
+		}
+	}
+	l.mux.Lock()
+	conn := l.route(idx, rAddr, pkt)
+	l.mux.Unlock()
+	if conn != nil {
+		conn.deliver(idx, rAddr, pkt)
+	}
+}
+
+// known reports whether datagram is routed to existing connection.
+func (l *muxListener) known(idx int, rAddr netip.AddrPort, pkt []byte) bool {
+	if l.cidLen > 0 && len(pkt) >= cidRecordOffset+l.cidLen && pkt[0] == contentTypeCID {
+		if _, ok := l.byCID[string(pkt[cidRecordOffset:cidRecordOffset+l.cidLen])]; ok {
+			return true
+		}
+	}
+	_, ok := l.byTuple[tupleKey{idx, rAddr}]
+	return ok
+}
+
+func (l *muxListener) route(idx int, rAddr netip.AddrPort, pkt []byte) *muxConn {
+	if l.cidLen > 0 && len(pkt) >= cidRecordOffset+l.cidLen && pkt[0] == contentTypeCID {
+		return l.byCID[string(pkt[cidRecordOffset:cidRecordOffset+l.cidLen])]
+	}
+
+	key := tupleKey{idx, rAddr}
+	if conn, ok := l.byTuple[key]; ok {
+		return conn
+	}
+
+	if len(pkt) == 0 || pkt[0] != contentTypeHandshake {
+		return nil
+	}
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+
+	conn := newMuxConn(l, key)
+	if l.cidLen > 0 {
+		for {
+			cid := make([]byte, l.cidLen)
+			if _, err := rand.Read(cid); err != nil {
+				return nil
+			}
+			if _, ok := l.byCID[string(cid)]; !ok {
+				conn.cid = cid
+				break
+			}
+		}
+	}
+	select {
+	case l.acceptCh <- conn:
+	default:
+		// accept queue is full
+		return nil
+	}
+	l.byTuple[key] = conn
+	if conn.cid != nil {
+		l.byCID[string(conn.cid)] = conn
+	}
+	return conn
+}
+
+func (l *muxListener) unregister(conn *muxConn) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.byTuple[conn.key] == conn {
+		delete(l.byTuple, conn.key)
+	}
+	if conn.cid != nil && l.byCID[string(conn.cid)] == conn {
+		delete(l.byCID, string(conn.cid))
+	}
+}
+
+// Accept returns packet connection for a new peer. If connection ID
+// support is enabled, connection ID is already assigned to it.
+func (l *muxListener) Accept() (*muxConn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.once.Do(func() {
+		l.mux.Lock()
+		close(l.closed)
+		l.mux.Unlock()
+		var errs []error
+		for _, socket := range l.sockets {
+			if err := socket.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		l.closeErr = errors.Join(errs...)
+		l.wg.Wait()
+	})
+	return l.closeErr
+}
+
+type muxPacket struct {
+	data   []byte
+	socket int
+	addr   netip.AddrPort
+}
+
+// muxConn is a net.PacketConn for a single peer of muxListener. Replies
+// are sent from the socket on which the latest authenticated record of
+// peer arrived. Records are authenticated by DTLS connection, which adopts
+// address returned along with the latest valid connection ID record as
+// its remote address. Address of each read is a distinct value, so the
+// record which moved the peer is recognized by identity of its address.
+type muxConn struct {
+	listener     *muxListener
+	key          tupleKey
+	cid          []byte
+	mux          sync.Mutex
+	remote       func() net.Addr
+	lastAddr     *net.UDPAddr
+	lastSocket   int
+	reply        tupleKey
+	readCh       chan muxPacket
+	readDeadline *deadline.Deadline
+	closed       chan struct{}
+	once         sync.Once
+}
+
+func newMuxConn(l *muxListener, key tupleKey) *muxConn {
+	return &muxConn{
+		listener:     l,
+		key:          key,
+		reply:        key,
+		readCh:       make(chan muxPacket, connQueueLength),
+		readDeadline: deadline.New(),
+		closed:       make(chan struct{}),
+	}
+}
+
+// trackRemote sets function which returns remote address authenticated by
+// DTLS connection on top of c.
+func (c *muxConn) trackRemote(remote func() net.Addr) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.remote = remote
+}
+
+// updateReply switches reply socket to the socket of the last read if
+// its address became authenticated remote address. c.mux must be held.
+func (c *muxConn) updateReply(remote net.Addr) {
+	if addr, ok := remote.(*net.UDPAddr); ok && c.lastAddr != nil && addr == c.lastAddr {
+		c.reply = tupleKey{c.lastSocket, unmapAddrPort(addr)}
+		c.lastAddr = nil
+	}
+}
+
+func (c *muxConn) deliver(idx int, rAddr netip.AddrPort, pkt []byte) {
+	select {
+	case c.readCh <- muxPacket{bytes.Clone(pkt), idx, rAddr}:
+	default:
+		// drop packet if reader is lagging behind
+	}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.readDeadline.Done():
+		return 0, nil, c.readDeadline.Err()
+	case pkt := <-c.readCh:
+		// previous datagram is processed by DTLS connection at this point
+		c.mux.Lock()
+		remote := c.remote
+		c.mux.Unlock()
+		var authAddr net.Addr
+		if remote != nil {
+			authAddr = remote()
+		}
+		addr := net.UDPAddrFromAddrPort(pkt.addr)
+		c.mux.Lock()
+		c.updateReply(authAddr)
+		c.lastAddr, c.lastSocket = addr, pkt.socket
+		c.mux.Unlock()
+		return copy(b, pkt.data), addr, nil
+	}
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("unsupported address type")
+	}
+	addrPort := unmapAddrPort(udpAddr)
+	// DTLS connection writes to its authenticated remote address, which
+	// may be adopted while the last datagram is being processed
+	c.mux.Lock()
+	c.updateReply(addr)
+	idx := c.key.socket
+	if c.reply.remote == addrPort {
+		idx = c.reply.socket
+	}
+	c.mux.Unlock()
+	return c.listener.sockets[idx].WriteToUDPAddrPort(b, addrPort)
+}
+
+func unmapAddrPort(addr *net.UDPAddr) netip.AddrPort {
+	addrPort := addr.AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
+
+func (c *muxConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.listener.unregister(c)
+	})
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.listener.sockets[c.key.socket].LocalAddr()
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.key.remote)
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op since sockets are shared between
+// connections.
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMuxListenerCIDRouting(t *testing.T) {
+	l, err := listenMux([]netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:0"),
+		netip.MustParseAddrPort("127.0.0.1:0"),
+	}, 4, nil)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("peer listen failed: %v", err)
+	}
+	defer peer.Close()
+
+	hello := []byte{contentTypeHandshake, 0xfe, 0xfd, 1, 2, 3}
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer conn.Close()
+	if len(conn.cid) != 4 {
+		t.Fatalf("unexpected CID length: %d", len(conn.cid))
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != string(hello) {
+		t.Fatalf("unexpected read: %v, %v", buf[:n], err)
+	}
+
+	// record with connection ID arriving from another socket and port
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("peer listen failed: %v", err)
+	}
+	defer other.Close()
+	record := make([]byte, cidRecordOffset, cidRecordOffset+len(conn.cid)+2)
+	record[0] = contentTypeCID
+	record = append(record, conn.cid...)
+	record = append(record, 0, 0)
+	other.WriteTo(record, l.sockets[1].LocalAddr())
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != string(record) {
+		t.Fatalf("unexpected read: %v, %v", buf[:n], err)
+	}
+	if addr.String() != other.LocalAddr().String() {
+		t.Fatalf("unexpected source address: %s", addr)
+	}
+
+	// reply goes out of the socket where peer address was seen
+	conn.WriteTo([]byte("reply"), addr)
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := other.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("unexpected reply: %q, %v", buf[:n], err)
+	}
+	if from.String() != l.sockets[1].LocalAddr().String() {
+		t.Fatalf("reply sent from unexpected socket: %s", from)
+	}
+
+	// non-handshake datagrams from unknown peers are dropped
+	other.WriteTo([]byte{23, 0xfe, 0xfd}, l.sockets[0].LocalAddr())
+	select {
+	case c := <-l.acceptCh:
+		t.Fatalf("unexpected connection from %s", c.RemoteAddr())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMuxListenerAdmit(t *testing.T) {
+	var open atomic.Bool
+	l, err := listenMux([]netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:0"),
+	}, 0, func(int, netip.AddrPort, []byte) bool {
+		return open.Load()
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("peer listen failed: %v", err)
+	}
+	defer peer.Close()
+
+	hello := []byte{contentTypeHandshake, 0xfe, 0xfd, 1, 2, 3}
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	select {
+	case c := <-l.acceptCh:
+		t.Fatalf("unexpected connection from %s", c.RemoteAddr())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	open.Store(true)
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	// datagrams of known peers are not checked
+	open.Store(false)
+	peer.WriteTo([]byte("data"), l.sockets[0].LocalAddr())
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+	}
+	if string(buf[:4]) != "data" {
+		t.Fatalf("unexpected read: %q", buf[:4])
+	}
+}
+
+func TestMuxConnReplySocket(t *testing.T) {
+	l, err := listenMux([]netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:0"),
+		netip.MustParseAddrPort("127.0.0.1:0"),
+	}, 4, nil)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("peer listen failed: %v", err)
+	}
+	defer peer.Close()
+
+	hello := []byte{contentTypeHandshake, 0xfe, 0xfd, 1, 2, 3}
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer conn.Close()
+	// stands for remote address of DTLS connection
+	var authAddr atomic.Pointer[net.UDPAddr]
+	authAddr.Store(net.UDPAddrFromAddrPort(conn.key.remote))
+	conn.trackRemote(func() net.Addr {
+		return authAddr.Load()
+	})
+
+	record := make([]byte, cidRecordOffset, cidRecordOffset+len(conn.cid)+2)
+	record[0] = contentTypeCID
+	record = append(record, conn.cid...)
+	record = append(record, 0, 0)
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	read := func() *net.UDPAddr {
+		t.Helper()
+		_, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		return addr.(*net.UDPAddr)
+	}
+	expectReplyFrom := func(socket int) {
+		t.Helper()
+		conn.WriteTo([]byte("reply"), authAddr.Load())
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := peer.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "reply" {
+			t.Fatalf("unexpected reply: %q, %v", buf[:n], err)
+		}
+		if from.String() != l.sockets[socket].LocalAddr().String() {
+			t.Fatalf("reply sent from unexpected socket: %s", from)
+		}
+	}
+	read()
+
+	// record which is not authenticated doesn't move replies
+	peer.WriteTo(record, l.sockets[1].LocalAddr())
+	read()
+	peer.WriteTo(hello, l.sockets[0].LocalAddr())
+	read()
+	expectReplyFrom(0)
+
+	// authenticated record does, even if followed by other datagrams
+	peer.WriteTo(record, l.sockets[1].LocalAddr())
+	authAddr.Store(read())
+	for range 3 {
+		peer.WriteTo(record, l.sockets[0].LocalAddr())
+		read()
+	}
+	expectReplyFrom(1)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ProxyProtocolMode specifies how PROXY protocol v2 header is sent to
+// upstream.
+type ProxyProtocolMode int
+
+const (
+	ProxyProtocolOff ProxyProtocolMode = iota
+	// ProxyProtocolFirst sends header as a separate datagram before
+	// any session traffic.
+	ProxyProtocolFirst
+	// ProxyProtocolEach prepends header to every datagram sent to
+	// upstream.
+	ProxyProtocolEach
+)
+
+func (m *ProxyProtocolMode) String() string {
+	if m == nil {
+		return "<nil>"
+	}
+	switch *m {
+	case ProxyProtocolOff:
+		return "off"
+	case ProxyProtocolFirst:
+		return "first"
+	case ProxyProtocolEach:
+		return "each"
+	}
+	return "<unknown>"
+}
+
+func (m *ProxyProtocolMode) Set(val string) error {
+	switch val {
+	case "off", "":
+		*m = ProxyProtocolOff
+	case "first":
+		*m = ProxyProtocolFirst
+	case "each":
+		*m = ProxyProtocolEach
+	default:
+		return errors.New("unknown PROXY protocol mode")
+	}
+	return nil
+}
+
+const (
+	// PP2TypeIdentity is TLV type carrying client PSK identity. It is
+	// the first value of custom application range of PROXY protocol v2.
+	PP2TypeIdentity = 0xE0
+
+	pp2VersionProxy = 0x21
+	pp2FamilyUDP4   = 0x12
+	pp2FamilyUDP6   = 0x22
+)
+
+var pp2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader builds PROXY protocol v2 header for UDP datagrams sent by
+// src to dst. If identity is not nil, it's added as PP2TypeIdentity TLV.
+// Addresses of different families are both represented as IPv6.
+func ProxyHeader(src, dst netip.AddrPort, identity []byte) ([]byte, error) {
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	family := byte(pp2FamilyUDP4)
+	var addrs []byte
+	if srcAddr.Is4() && dstAddr.Is4() {
+		addrs = append(srcAddr.AsSlice(), dstAddr.AsSlice()...)
+	} else {
+		family = pp2FamilyUDP6
+		src16, dst16 := srcAddr.As16(), dstAddr.As16()
+		addrs = append(src16[:], dst16[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+
+	payload := addrs
+	if identity != nil {
+		if len(identity) > 0xFFFF {
+			return nil, fmt.Errorf("identity is too long: %d bytes", len(identity))
+		}
+		payload = append(payload, PP2TypeIdentity)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(identity)))
+		payload = append(payload, identity...)
+	}
+	if len(payload) > 0xFFFF {
+		return nil, errors.New("PROXY header is too long")
+	}
+
+	header := make([]byte, 0, len(pp2Signature)+4+len(payload))
+	header = append(header, pp2Signature...)
+	header = append(header, pp2VersionProxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	header = append(header, payload...)
+	return header, nil
+}
+
+// proxyConn prepends PROXY protocol header to each written datagram.
+type proxyConn struct {
+	net.Conn
+	header []byte
+}
+
+func (c *proxyConn) Write(b []byte) (int, error) {
+	buf := make([]byte, 0, len(c.header)+len(b))
+	buf = append(buf, c.header...)
+	buf = append(buf, b...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func withProxyHeader(conn net.Conn, mode ProxyProtocolMode, header []byte) (net.Conn, error) {
+	switch mode {
+	case ProxyProtocolFirst:
+		if _, err := conn.Write(header); err != nil {
+			return nil, fmt.Errorf("can't send PROXY header: %w", err)
+		}
+	case ProxyProtocolEach:
+		return &proxyConn{conn, header}, nil
+	}
+	return conn, nil
+}
+
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort()
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestProxyHeaderIPv4(t *testing.T) {
+	header, err := ProxyHeader(
+		netip.MustParseAddrPort("192.0.2.1:1000"),
+		netip.MustParseAddrPort("[::ffff:198.51.100.2]:443"),
+		[]byte("wg"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x12, 0, 17,
+		192, 0, 2, 1,
+		198, 51, 100, 2,
+		0x03, 0xe8, 0x01, 0xbb,
+		0xe0, 0, 2, 'w', 'g',
+	)
+	if !bytes.Equal(header, want) {
+		t.Errorf("got %v, want %v", header, want)
+	}
+}
+
+func TestProxyHeaderMixedFamilies(t *testing.T) {
+	header, err := ProxyHeader(
+		netip.MustParseAddrPort("192.0.2.1:1000"),
+		netip.MustParseAddrPort("[2001:db8::1]:443"),
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(header) != 16+36 {
+		t.Fatalf("unexpected header length: %d", len(header))
+	}
+	if header[13] != 0x22 || header[14] != 0 || header[15] != 36 {
+		t.Errorf("unexpected family and length: %v", header[13:16])
+	}
+	if !bytes.Equal(header[16:32], netip.MustParseAddr("::ffff:192.0.2.1").AsSlice()) {
+		t.Errorf("unexpected source address: %v", header[16:32])
+	}
+}
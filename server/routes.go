@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+func LoadRoutesFile(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't open routes file: %w", err)
+	}
+	defer f.Close()
+	routes, err := ParseRoutes(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't load routes file %q: %w", filename, err)
+	}
+	return routes, nil
+}
+
+// ParseRoutes reads identity to upstream address mapping. Each non-empty
+// line holds identity and address separated by whitespace. Lines starting
+// with '#' are ignored.
+func ParseRoutes(r io.Reader) (map[string]string, error) {
+	routes := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected identity and address, got %d fields", lineNum, len(fields))
+		}
+		identity, address := fields[0], fields[1]
+		if _, ok := routes[identity]; ok {
+			return nil, fmt.Errorf("line %d: duplicate identity %q", lineNum, identity)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("line %d: bad address %q: %w", lineNum, address, err)
+		}
+		routes[identity] = address
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("routes read failed: %w", err)
+	}
+	return routes, nil
+}
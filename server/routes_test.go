@@ -0,0 +1,64 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	input := `
+# identity upstream
+wg 127.0.0.1:51820
+syslog	127.0.0.1:514
+dns [::1]:53
+`
+	routes, err := ParseRoutes(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"wg":     "127.0.0.1:51820",
+		"syslog": "127.0.0.1:514",
+		"dns":    "[::1]:53",
+	}
+	if len(routes) != len(expected) {
+		t.Fatalf("unexpected routes count: %d", len(routes))
+	}
+	for identity, address := range expected {
+		if routes[identity] != address {
+			t.Errorf("unexpected route for %q: %q", identity, routes[identity])
+		}
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	for _, input := range []string{
+		"wg",
+		"wg 127.0.0.1:51820 extra",
+		"wg 127.0.0.1",
+		"wg 127.0.0.1:1\nwg 127.0.0.1:2",
+	} {
+		if _, err := ParseRoutes(strings.NewReader(input)); err == nil {
+			t.Errorf("expected error for input %q", input)
+		}
+	}
+}
+
+func TestRouteFor(t *testing.T) {
+	s := &settings{
+		remoteAddress: "127.0.0.1:1",
+		routes: map[string]string{
+			"wg": "127.0.0.1:51820",
+		},
+	}
+	if addr, ok := s.routeFor([]byte("wg")); !ok || addr != "127.0.0.1:51820" {
+		t.Errorf("unexpected route: %q, %v", addr, ok)
+	}
+	if addr, ok := s.routeFor([]byte("other")); !ok || addr != "127.0.0.1:1" {
+		t.Errorf("unexpected default route: %q, %v", addr, ok)
+	}
+	s.remoteAddress = ""
+	if _, ok := s.routeFor([]byte("other")); ok {
+		t.Errorf("unexpected route without default")
+	}
+}
@@ -2,35 +2,122 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/SenseUnit/dtlspipe/affinity"
+	"github.com/SenseUnit/dtlspipe/chaff"
+	"github.com/SenseUnit/dtlspipe/ciphers"
+	"github.com/SenseUnit/dtlspipe/flowmux"
+	"github.com/SenseUnit/dtlspipe/hsprofile"
+	"github.com/SenseUnit/dtlspipe/knock"
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/padding"
+	"github.com/SenseUnit/dtlspipe/resumption"
+	"github.com/SenseUnit/dtlspipe/session"
 	"github.com/SenseUnit/dtlspipe/util"
 	"github.com/pion/dtls/v3"
 )
 
 const (
-	Backlog = 1024
+	Backlog         = 1024
+	serverCIDLength = 8
 )
 
-type Server struct {
-	listener      net.Listener
-	dialer        *net.Dialer
-	dtlsConfig    *dtls.Config
-	rAddr         string
+type settings struct {
+	remoteAddress string
+	routes        map[string]string
 	psk           func([]byte) ([]byte, error)
-	timeout       time.Duration
+	certificate   *tls.Certificate
+	verifyClient  func([][]byte, [][]*x509.Certificate) error
+	peerKeys      map[string]string
+	trustSubject  bool
 	idleTimeout   time.Duration
-	baseCtx       context.Context
-	cancelCtx     func()
-	staleMode     util.StaleMode
-	workerWG      sync.WaitGroup
 	timeLimitFunc func() time.Duration
 	allowFunc     func(net.Addr) bool
+	cipherSuites  ciphers.CipherList
+}
+
+func settingsFromConfig(cfg *Config) *settings {
+	s := &settings{
+		remoteAddress: cfg.RemoteAddress,
+		routes:        cfg.Routes,
+		psk:           cfg.PSKCallback,
+		idleTimeout:   cfg.IdleTimeout,
+		timeLimitFunc: cfg.TimeLimitFunc,
+		allowFunc:     cfg.AllowFunc,
+		cipherSuites:  cfg.CipherSuites,
+		peerKeys:      cfg.PeerKeys,
+		trustSubject:  cfg.ClientCAs != nil,
+	}
+	if len(cfg.Certificates) > 0 {
+		s.certificate = &cfg.Certificates[0]
+	}
+	if cfg.ClientCAs != nil {
+		s.verifyClient = util.VerifyClientCert(cfg.ClientCAs)
+	}
+	if cfg.PeerKeys != nil {
+		pins := make([][]byte, 0, len(cfg.PeerKeys))
+		for fp := range cfg.PeerKeys {
+			pins = append(pins, []byte(fp))
+		}
+		verifyKey := util.VerifySPKIPins(pins)
+		if verifyCA := s.verifyClient; verifyCA != nil {
+			s.verifyClient = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+				if err := verifyCA(rawCerts, chains); err != nil {
+					return err
+				}
+				return verifyKey(rawCerts, chains)
+			}
+		} else {
+			s.verifyClient = verifyKey
+		}
+	}
+	return s
+}
+
+func (s *settings) routeFor(identity []byte) (string, bool) {
+	if addr, ok := s.routes[string(identity)]; ok {
+		return addr, true
+	}
+	return s.remoteAddress, s.remoteAddress != ""
+}
+
+type Server struct {
+	listener   *muxListener
+	dialer     *net.Dialer
+	dtlsConfig *dtls.Config
+	timeout    time.Duration
+	baseCtx    context.Context
+	cancelCtx  func()
+	sessions   *session.Registry
+	pairStats  *util.PairStats
+	staleMode  util.StaleMode
+	proxyMode  ProxyProtocolMode
+	proxyID    bool
+	certMode   bool
+	clientAuth bool
+	sessCache  *resumption.Cache
+	upstreams  *upstreamTable
+	padding    padding.Distribution
+	chaff      chaff.Schedule
+	chaffBgt   *chaff.Budget
+	gate       *knock.Gate
+	knockVf    *knockVerifier
+	knockLn    *knockListener
+	logger     *slog.Logger
+	workerWG   sync.WaitGroup
+	settings   atomic.Pointer[settings]
 }
 
 func New(cfg *Config) (*Server, error) {
@@ -39,19 +126,29 @@ func New(cfg *Config) (*Server, error) {
 	baseCtx, cancelCtx := context.WithCancel(cfg.BaseContext)
 
 	srv := &Server{
-		dialer:        new(net.Dialer),
-		rAddr:         cfg.RemoteAddress,
-		timeout:       cfg.Timeout,
-		psk:           cfg.PSKCallback,
-		idleTimeout:   cfg.IdleTimeout,
-		baseCtx:       baseCtx,
-		cancelCtx:     cancelCtx,
-		staleMode:     cfg.StaleMode,
-		timeLimitFunc: cfg.TimeLimitFunc,
-		allowFunc:     cfg.AllowFunc,
+		dialer:     new(net.Dialer),
+		timeout:    cfg.Timeout,
+		baseCtx:    baseCtx,
+		cancelCtx:  cancelCtx,
+		staleMode:  cfg.StaleMode,
+		proxyMode:  cfg.ProxyProtocol,
+		proxyID:    cfg.ProxyIdentity,
+		certMode:   len(cfg.Certificates) > 0,
+		clientAuth: len(cfg.Certificates) > 0 && (cfg.ClientCAs != nil || cfg.PeerKeys != nil),
+		sessCache:  cfg.SessionCache,
+		padding:    cfg.Padding,
+		chaff:      cfg.Chaff,
+		chaffBgt:   chaff.NewBudget(cfg.ChaffBudget),
+		logger:     cfg.Logger,
+		sessions:   cfg.Sessions,
+		pairStats:  util.NewPairStats("server", cfg.StaleMode),
+	}
+	srv.settings.Store(settingsFromConfig(cfg))
+	if cfg.UpstreamGrace > 0 {
+		srv.upstreams = newUpstreamTable(cfg.UpstreamGrace)
 	}
 
-	lAddrPort, err := netip.ParseAddrPort(cfg.BindAddress)
+	lAddrPorts, err := ParseBindSpec(cfg.BindAddress)
 	if err != nil {
 		cancelCtx()
 		return nil, fmt.Errorf("can't parse bind address: %w", err)
@@ -59,25 +156,94 @@ func New(cfg *Config) (*Server, error) {
 
 	srv.dtlsConfig = &dtls.Config{
 		ExtendedMasterSecret:    dtls.RequireExtendedMasterSecret,
-		PSK:                     srv.psk,
 		MTU:                     cfg.MTU,
 		InsecureSkipVerifyHello: cfg.SkipHelloVerify,
 		CipherSuites:            cfg.CipherSuites,
 		EllipticCurves:          cfg.EllipticCurves,
+		SupportedProtocols:      supportedProtocols(),
 		OnConnectionAttempt: func(a net.Addr) error {
-			if !srv.allowFunc(a) {
+			if !srv.settings.Load().allowFunc(a) {
+				metrics.RateLimitRejections.With("server").Inc()
 				return fmt.Errorf("address %s was not allowed by limiter", a.String())
 			}
+			if srv.gate != nil {
+				if udpAddr, ok := a.(*net.UDPAddr); !ok || !srv.gate.Allowed(udpAddr.AddrPort().Addr().Unmap()) {
+					return fmt.Errorf("address %s didn't knock", a.String())
+				}
+			}
+			return nil
+		},
+		VerifyConnection: func(state *dtls.State) error {
+			if !slices.Contains(srv.settings.Load().cipherSuites, state.CipherSuiteID) {
+				return fmt.Errorf("cipher suite %s is not allowed", ciphers.CipherIDToString(state.CipherSuiteID))
+			}
 			return nil
 		},
 	}
+	if srv.certMode {
+		srv.dtlsConfig.GetCertificate = func(*dtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return srv.settings.Load().certificate, nil
+		}
+		if srv.clientAuth {
+			srv.dtlsConfig.ClientAuth = dtls.RequireAnyClientCert
+			srv.dtlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+				return srv.settings.Load().verifyClient(rawCerts, chains)
+			}
+		}
+	} else {
+		srv.dtlsConfig.PSK = func(hint []byte) ([]byte, error) {
+			return srv.settings.Load().psk(hint)
+		}
+	}
+	if srv.sessCache != nil {
+		srv.dtlsConfig.SessionStore = srv.sessCache
+	}
+	if cfg.AcceptProfiles {
+		srv.dtlsConfig.SRTPProtectionProfiles = hsprofile.SRTPProtectionProfiles
+	}
+	var admit func(int, netip.AddrPort, []byte) bool
+	if cfg.Knock || len(cfg.KnockPorts) > 0 {
+		if cfg.Knock && srv.certMode {
+			cancelCtx()
+			return nil, errors.New("knock datagrams require PSK authentication")
+		}
+		srv.gate = knock.NewGate(knock.GateConfig{
+			Authenticated: cfg.Knock,
+			Sequence:      len(cfg.KnockPorts),
+			TTL:           cfg.KnockTTL,
+		})
+		if cfg.Knock {
+			srv.knockVf = newKnockVerifier(srv.gate, func(identity []byte) ([]byte, error) {
+				return srv.settings.Load().psk(identity)
+			}, srv.logger)
+		}
+		admit = srv.admit
+	}
+	cidLen := 0
 	if cfg.EnableCID {
-		srv.dtlsConfig.ConnectionIDGenerator = dtls.RandomCIDGenerator(8)
+		cidLen = serverCIDLength
 	}
-	srv.listener, err = dtls.Listen("udp", net.UDPAddrFromAddrPort(lAddrPort), srv.dtlsConfig)
+	srv.listener, err = listenMux(lAddrPorts, cidLen, admit)
 	if err != nil {
 		cancelCtx()
-		return nil, fmt.Errorf("can't initialize DTLS listener: %w", err)
+		if srv.knockVf != nil {
+			srv.knockVf.Close()
+		}
+		return nil, fmt.Errorf("can't initialize listener: %w", err)
+	}
+	if srv.knockVf != nil {
+		srv.knockVf.setDeliver(srv.listener.dispatch)
+	}
+	if len(cfg.KnockPorts) > 0 {
+		srv.knockLn, err = listenKnock(lAddrPorts, cfg.KnockPorts, srv.gate)
+		if err != nil {
+			cancelCtx()
+			srv.listener.Close()
+			if srv.knockVf != nil {
+				srv.knockVf.Close()
+			}
+			return nil, fmt.Errorf("can't listen knock ports: %w", err)
+		}
 	}
 
 	go srv.listen()
@@ -85,14 +251,61 @@ func New(cfg *Config) (*Server, error) {
 	return srv, nil
 }
 
+// Reload applies RemoteAddress, Routes, PSKCallback, Certificates,
+// ClientCAs, PeerKeys, IdleTimeout, TimeLimitFunc, AllowFunc and
+// CipherSuites from cfg to sessions established after the call. Other fields of cfg are
+// ignored. Cipher suites not enabled at server startup can't be allowed
+// by reload. Authentication mode and client certificate requirement
+// can't be changed by reload. Session cache is cleared, so resumed
+// sessions are authenticated with new settings.
+func (srv *Server) Reload(cfg *Config) error {
+	cfg = cfg.populateDefaults()
+	if (len(cfg.Certificates) > 0) != srv.certMode {
+		return errors.New("authentication mode can't be changed without restart")
+	}
+	if srv.certMode && (cfg.ClientCAs != nil || cfg.PeerKeys != nil) != srv.clientAuth {
+		return errors.New("client certificate requirement can't be changed without restart")
+	}
+	for _, id := range cfg.CipherSuites {
+		if !slices.Contains(srv.dtlsConfig.CipherSuites, id) {
+			return fmt.Errorf("cipher suite %s was not enabled at startup and can't be allowed without restart", ciphers.CipherIDToString(id))
+		}
+	}
+	srv.settings.Store(settingsFromConfig(cfg))
+	if srv.sessCache != nil {
+		if err := srv.sessCache.Clear(); err != nil {
+			return fmt.Errorf("can't clear session cache: %w", err)
+		}
+	}
+	return nil
+}
+
 func (srv *Server) listen() {
 	defer srv.Close()
 	for srv.baseCtx.Err() == nil {
-		conn, err := srv.listener.Accept()
+		pconn, err := srv.listener.Accept()
+		if err != nil {
+			if srv.baseCtx.Err() != nil {
+				return
+			}
+			srv.logger.Warn("conn accept failed", util.ErrorAttrs(err)...)
+			continue
+		}
+
+		dtlsConfig := srv.dtlsConfig
+		if pconn.cid != nil {
+			cfg := *srv.dtlsConfig
+			cfg.ConnectionIDGenerator = func() []byte {
+				return pconn.cid
+			}
+			dtlsConfig = &cfg
+		}
+		conn, err := dtls.Server(pconn, pconn.RemoteAddr(), dtlsConfig)
 		if err != nil {
-			log.Printf("DTLS conn accept failed: %v", err)
+			pconn.Close()
 			continue
 		}
+		pconn.trackRemote(conn.RemoteAddr)
 
 		srv.workerWG.Add(1)
 		go func(conn net.Conn) {
@@ -104,9 +317,9 @@ func (srv *Server) listen() {
 }
 
 func (srv *Server) serve(conn net.Conn) {
-	log.Printf("[+] conn %s <=> %s", conn.LocalAddr(), conn.RemoteAddr())
-	defer log.Printf("[-] conn %s <=> %s", conn.LocalAddr(), conn.RemoteAddr())
 	defer conn.Close()
+	logger := util.ConnLogger(srv.logger, conn)
+	logger.Debug("conn accepted")
 
 	if handshaker, ok := conn.(interface {
 		HandshakeContext(context.Context) error
@@ -117,36 +330,259 @@ func (srv *Server) serve(conn net.Conn) {
 			return handshaker.HandshakeContext(hsCtx)
 		}()
 		if err != nil {
-			log.Printf("handshake %s <=> %s failed: %v", conn.LocalAddr(), conn.RemoteAddr(), err)
+			metrics.Handshakes.With("server", "failure", util.HandshakeFailureReason(err)).Inc()
+			logger.Info("handshake failed", util.ErrorAttrs(err)...)
 			return
 		}
+		metrics.Handshakes.With("server", "success", "").Inc()
+	}
+	if _, padded := padding.SplitProtocol(negotiatedProtocol(conn)); padded {
+		conn = padding.NewConn(conn, srv.padding, padding.MaxSize(srv.dtlsConfig.MTU))
+	}
+	if _, ok := chaff.SplitProtocol(negotiatedProtocol(conn)); ok {
+		cc := chaff.NewConn(conn, "server", srv.chaff, srv.chaffBgt)
+		defer cc.Close()
+		go cc.Run()
+		conn = cc
+	}
+
+	current := srv.settings.Load()
+	identity := srv.resumedIdentity(conn, current.identityOf(conn))
+	logger = logger.With(slog.String(util.LogKeyIdentity, string(identity)))
+	rAddr, ok := current.routeFor(identity)
+	if !ok {
+		logger.Warn("no upstream route for identity")
+		return
 	}
 
 	ctx := srv.baseCtx
-	tl := srv.timeLimitFunc()
+	tl := current.timeLimitFunc()
 	if tl != 0 {
 		newCtx, cancel := context.WithTimeout(ctx, tl)
 		defer cancel()
 		ctx = newCtx
 	}
 
-	remoteConn, err := func() (net.Conn, error) {
+	protocol, keepalive := util.SplitKeepaliveProtocol(negotiatedProtocol(conn))
+	var token []byte
+	switch protocol {
+	case flowmux.Protocol:
+		srv.serveMux(ctx, logger, conn, identity, rAddr, current, keepalive)
+		return
+	case affinity.Protocol:
+		var err error
+		token, err = affinity.ReadToken(conn, current.idleTimeout)
+		if err != nil {
+			logger.Warn("session token read failed", util.ErrorAttrs(err)...)
+			return
+		}
+	}
+	if keepalive {
+		conn = keepaliveFilter{conn}
+	}
+	srv.serveFlow(ctx, logger, conn, identity, token, rAddr, current)
+}
+
+// serveMux forwards each flow of multiplexed connection to a separate
+// upstream socket. All flows are closed when ctx is done. If keepalive
+// is set, keepalives are discarded from each flow.
+func (srv *Server) serveMux(ctx context.Context, logger *slog.Logger, conn net.Conn, identity []byte, rAddr string, current *settings, keepalive bool) {
+	mc := flowmux.Server(conn, current.idleTimeout)
+	defer mc.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			mc.Close()
+		case <-mc.Done():
+		}
+	}()
+	logger.Info("multiplexed connection started")
+	defer logger.Info("multiplexed connection closed")
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		flow, err := mc.Accept()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer flow.Close()
+			flowLogger := logger.With(slog.Uint64(util.LogKeyFlow, uint64(flow.ID())))
+			var flowConn net.Conn = flow
+			if keepalive {
+				flowConn = keepaliveFilter{flow}
+			}
+			srv.serveFlow(ctx, flowLogger, flowConn, identity, nil, rAddr, current)
+		}()
+	}
+}
+
+// serveFlow forwards datagrams of conn to upstream rAddr. Sessions with
+// token reuse upstream socket of previous session with the same identity
+// and token.
+func (srv *Server) serveFlow(ctx context.Context, logger *slog.Logger, conn net.Conn, identity, token []byte, rAddr string, current *settings) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sess := session.New("server", conn.LocalAddr().String(), conn.RemoteAddr().String(), string(identity), rAddr, cancel)
+	logger = logger.With(
+		slog.String(util.LogKeySession, sess.ID()),
+		slog.String(util.LogKeyEndpoint, rAddr),
+	)
+
+	dial := func() (net.Conn, error) {
 		dialCtx, cancel := context.WithTimeout(ctx, srv.timeout)
 		defer cancel()
-		return srv.dialer.DialContext(dialCtx, "udp", srv.rAddr)
-	}()
+		return srv.dialer.DialContext(dialCtx, "udp", rAddr)
+	}
+	var remoteConn net.Conn
+	var reused bool
+	var err error
+	if srv.upstreams != nil && token != nil {
+		remoteConn, reused, err = srv.upstreams.acquire(string(identity)+"\x00"+string(token), rAddr, dial)
+	} else {
+		remoteConn, err = dial()
+	}
 	if err != nil {
-		log.Printf("remote dial failed: %v", err)
+		metrics.DialFailures.With("server", "upstream").Inc()
+		logger.Warn("remote dial failed", util.ErrorAttrs(err)...)
 		return
 	}
 	defer remoteConn.Close()
+	if reused {
+		logger.Info("upstream socket reattached", slog.String("upstream_local_addr", remoteConn.LocalAddr().String()))
+	}
 
-	util.PairConn(ctx, conn, remoteConn, srv.idleTimeout, srv.staleMode)
+	// upstream has already got header for reused socket in first mode
+	if srv.proxyMode == ProxyProtocolEach || srv.proxyMode == ProxyProtocolFirst && !reused {
+		var idTLV []byte
+		if srv.proxyID {
+			idTLV = identity
+			if idTLV == nil {
+				idTLV = []byte{}
+			}
+		}
+		header, err := ProxyHeader(addrPortOf(conn.RemoteAddr()), addrPortOf(conn.LocalAddr()), idTLV)
+		if err != nil {
+			logger.Warn("can't build PROXY header", util.ErrorAttrs(err)...)
+			return
+		}
+		remoteConn, err = withProxyHeader(remoteConn, srv.proxyMode, header)
+		if err != nil {
+			logger.Warn("upstream write failed", util.ErrorAttrs(err)...)
+			return
+		}
+	}
+
+	logger.Info("session started")
+	defer logger.Info("session closed")
+	srv.sessions.Add(sess)
+	defer srv.sessions.Remove(sess)
+
+	activeSessions := metrics.ActiveSessions.With("server")
+	activeSessions.Inc()
+	defer activeSessions.Dec()
+
+	util.PairConn(ctx, logger, conn, remoteConn, current.idleTimeout, srv.staleMode, srv.pairStats, sess.Stats())
+}
+
+// resumedIdentity remembers client identity for DTLS session and returns
+// remembered identity for resumed sessions, which carry neither PSK
+// identity hint nor client certificate.
+func (srv *Server) resumedIdentity(conn net.Conn, identity []byte) []byte {
+	if srv.sessCache == nil {
+		return identity
+	}
+	stater, ok := conn.(interface {
+		ConnectionState() (dtls.State, bool)
+	})
+	if !ok {
+		return identity
+	}
+	state, ok := stater.ConnectionState()
+	if !ok || len(state.SessionID) == 0 {
+		return identity
+	}
+	if tag, ok := srv.sessCache.Tag(state.SessionID); ok {
+		return []byte(tag)
+	}
+	srv.sessCache.SetTag(state.SessionID, string(identity))
+	return identity
+}
+
+// supportedProtocols returns ALPN protocols of all combinations of
+// protocol features.
+func supportedProtocols() []string {
+	var protocols []string
+	for _, base := range []string{"", flowmux.Protocol, affinity.Protocol} {
+		for _, withKeepalive := range []string{base, util.KeepaliveProtocolFor(base)} {
+			for _, withChaff := range []string{withKeepalive, chaff.ProtocolFor(withKeepalive)} {
+				for _, protocol := range []string{withChaff, padding.ProtocolFor(withChaff)} {
+					if protocol != "" {
+						protocols = append(protocols, protocol)
+					}
+				}
+			}
+		}
+	}
+	return protocols
+}
+
+func negotiatedProtocol(conn net.Conn) string {
+	if stater, ok := conn.(interface {
+		ConnectionState() (dtls.State, bool)
+	}); ok {
+		if state, ok := stater.ConnectionState(); ok {
+			return state.NegotiatedProtocol
+		}
+	}
+	return ""
 }
 
 func (srv *Server) Close() error {
 	srv.cancelCtx()
 	err := srv.listener.Close()
+	if srv.knockLn != nil {
+		err = errors.Join(err, srv.knockLn.Close())
+	}
+	if srv.knockVf != nil {
+		srv.knockVf.Close()
+	}
 	srv.workerWG.Wait()
+	if srv.upstreams != nil {
+		srv.upstreams.close()
+	}
 	return err
 }
+
+// identityOf returns PSK identity of client. In certificate mode client
+// is identified by identity assigned to its key in peer keys, by subject
+// of certificate verified with client CAs or else by key fingerprint.
+// Subject of certificate which isn't verified with CAs is chosen by
+// client, so it's never used.
+func (s *settings) identityOf(conn net.Conn) []byte {
+	if stater, ok := conn.(interface {
+		ConnectionState() (dtls.State, bool)
+	}); ok {
+		if state, ok := stater.ConnectionState(); ok {
+			if len(state.IdentityHint) > 0 || len(state.PeerCertificates) == 0 {
+				return state.IdentityHint
+			}
+			cert, err := x509.ParseCertificate(state.PeerCertificates[0])
+			if err != nil {
+				return nil
+			}
+			fp := util.SPKIHash(cert)
+			if identity := s.peerKeys[string(fp)]; identity != "" {
+				return []byte(identity)
+			}
+			if s.trustSubject {
+				return []byte(cert.Subject.CommonName)
+			}
+			return []byte(base64.StdEncoding.EncodeToString(fp))
+		}
+	}
+	return nil
+}
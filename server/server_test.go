@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/SenseUnit/dtlspipe/ciphers"
+	"github.com/SenseUnit/dtlspipe/util"
+	"github.com/pion/dtls/v3"
+)
+
+type stateConn struct {
+	net.Conn
+	state dtls.State
+}
+
+func (c stateConn) ConnectionState() (dtls.State, bool) {
+	return c.state, true
+}
+
+func TestIdentityOf(t *testing.T) {
+	key, err := util.GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := util.SelfSignedCertificate(key, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := string(util.SPKIHash(parsed))
+	conn := stateConn{state: dtls.State{PeerCertificates: cert.Certificate}}
+
+	s := &settings{peerKeys: map[string]string{fp: "phone"}}
+	if id := string(s.identityOf(conn)); id != "phone" {
+		t.Errorf("unexpected identity %q", id)
+	}
+	// subject of self-signed certificate is chosen by client
+	s = &settings{peerKeys: map[string]string{fp: ""}}
+	if id := string(s.identityOf(conn)); id != base64.StdEncoding.EncodeToString([]byte(fp)) {
+		t.Errorf("unexpected identity %q", id)
+	}
+	s = &settings{peerKeys: map[string]string{fp: ""}, trustSubject: true}
+	if id := string(s.identityOf(conn)); id != "admin" {
+		t.Errorf("unexpected identity %q", id)
+	}
+
+	conn = stateConn{state: dtls.State{IdentityHint: []byte("alice")}}
+	if id := string(s.identityOf(conn)); id != "alice" {
+		t.Errorf("unexpected identity %q", id)
+	}
+}
+
+func TestReload(t *testing.T) {
+	key, err := util.GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := util.SelfSignedCertificate(key, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk := func([]byte) ([]byte, error) { return []byte("0123456789abcdef"), nil }
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newServer := func(cfg Config) *Server {
+		cfg.BindAddress = "127.0.0.1:0"
+		cfg.RemoteAddress = "127.0.0.1:9"
+		cfg.Logger = logger
+		srv, err := New(&cfg)
+		if err != nil {
+			t.Fatalf("server startup failed: %v", err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		return srv
+	}
+
+	pskSrv := newServer(Config{
+		PSKCallback:  psk,
+		CipherSuites: ciphers.CipherList{dtls.TLS_PSK_WITH_AES_128_CCM, dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+	})
+	certSrv := newServer(Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	for _, tc := range []struct {
+		name string
+		srv  *Server
+		cfg  Config
+		err  string
+	}{
+		{
+			name: "certificates for PSK server",
+			srv:  pskSrv,
+			cfg:  Config{Certificates: []tls.Certificate{cert}},
+			err:  "authentication mode",
+		},
+		{
+			name: "PSK for certificate server",
+			srv:  certSrv,
+			cfg:  Config{PSKCallback: psk},
+			err:  "authentication mode",
+		},
+		{
+			name: "client certificate requirement",
+			srv:  certSrv,
+			cfg:  Config{Certificates: []tls.Certificate{cert}, PeerKeys: map[string]string{"fp": "phone"}},
+			err:  "client certificate requirement",
+		},
+		{
+			name: "cipher suite not enabled at startup",
+			srv:  pskSrv,
+			cfg:  Config{PSKCallback: psk, CipherSuites: ciphers.CipherList{dtls.TLS_PSK_WITH_AES_128_CCM_8}},
+			err:  "was not enabled at startup",
+		},
+	} {
+		before := tc.srv.settings.Load()
+		err := tc.srv.Reload(&tc.cfg)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if tc.srv.settings.Load() != before {
+			t.Errorf("%s: settings are changed by failed reload", tc.name)
+		}
+	}
+
+	err = pskSrv.Reload(&Config{
+		RemoteAddress: "127.0.0.1:10",
+		PSKCallback:   psk,
+		CipherSuites:  ciphers.CipherList{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	current := pskSrv.settings.Load()
+	if current.remoteAddress != "127.0.0.1:10" || len(current.cipherSuites) != 1 {
+		t.Errorf("settings are not reloaded: %+v", current)
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamTable keeps upstream sockets of sessions with session token
+// for grace period after session end, so client reconnecting with the
+// same token is attached to the same upstream socket and upstream
+// doesn't see new source port.
+type upstreamTable struct {
+	grace time.Duration
+
+	mux     sync.Mutex
+	entries map[string]*upstreamEntry
+	closed  bool
+}
+
+type upstreamEntry struct {
+	conn  net.Conn
+	addr  string
+	lease *upstreamLease
+	timer *time.Timer
+}
+
+func newUpstreamTable(grace time.Duration) *upstreamTable {
+	return &upstreamTable{
+		grace:   grace,
+		entries: make(map[string]*upstreamEntry),
+	}
+}
+
+// acquire returns upstream socket for key connected to addr. Socket is
+// taken from session which currently uses it or from parked sockets. If
+// there is no such socket, new one is created with dial. Returned flag
+// tells if socket was reused.
+func (t *upstreamTable) acquire(key, addr string, dial func() (net.Conn, error)) (net.Conn, bool, error) {
+	t.mux.Lock()
+	if t.closed {
+		t.mux.Unlock()
+		return nil, false, net.ErrClosed
+	}
+	e := t.entries[key]
+	if e != nil && e.addr != addr {
+		// route changed
+		t.dropLocked(key, e)
+		e = nil
+	}
+	if e == nil {
+		t.mux.Unlock()
+		conn, err := dial()
+		if err != nil {
+			return nil, false, err
+		}
+		t.mux.Lock()
+		defer t.mux.Unlock()
+		if t.closed {
+			conn.Close()
+			return nil, false, net.ErrClosed
+		}
+		if old := t.entries[key]; old != nil {
+			t.dropLocked(key, old)
+		}
+		e = &upstreamEntry{
+			conn: conn,
+			addr: addr,
+		}
+		t.entries[key] = e
+		e.lease = &upstreamLease{Conn: conn, table: t, key: key, entry: e}
+		return e.lease, false, nil
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	defer t.mux.Unlock()
+	if e.lease != nil {
+		e.lease.detach()
+	}
+	e.lease = &upstreamLease{Conn: e.conn, table: t, key: key, entry: e}
+	return e.lease, true, nil
+}
+
+// release parks socket of lease if lease still owns it.
+func (t *upstreamTable) release(lease *upstreamLease) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	e := lease.entry
+	if e.lease != lease || t.entries[lease.key] != e {
+		return
+	}
+	lease.detach()
+	e.lease = nil
+	e.timer = time.AfterFunc(t.grace, func() {
+		t.mux.Lock()
+		defer t.mux.Unlock()
+		if e.lease == nil && t.entries[lease.key] == e {
+			t.dropLocked(lease.key, e)
+		}
+	})
+}
+
+func (t *upstreamTable) dropLocked(key string, e *upstreamEntry) {
+	delete(t.entries, key)
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	if e.lease != nil {
+		e.lease.detached.Store(true)
+	}
+	e.conn.Close()
+}
+
+// close closes all sockets.
+func (t *upstreamTable) close() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.closed = true
+	for key, e := range t.entries {
+		t.dropLocked(key, e)
+	}
+}
+
+// upstreamLease is upstream socket used by one session. Closing lease
+// parks the socket. Detached lease behaves like closed connection and
+// doesn't affect the socket.
+type upstreamLease struct {
+	net.Conn
+	table    *upstreamTable
+	key      string
+	entry    *upstreamEntry
+	readMux  sync.Mutex
+	detached atomic.Bool
+	once     sync.Once
+}
+
+// detach stops lease from using socket. It returns after read in
+// progress is interrupted, so socket can be handed over to other session.
+// It's called with table lock held, which serializes hand-overs.
+func (l *upstreamLease) detach() {
+	l.detached.Store(true)
+	l.Conn.SetReadDeadline(time.Unix(1, 0))
+	l.readMux.Lock()
+	l.readMux.Unlock()
+}
+
+func (l *upstreamLease) Read(b []byte) (int, error) {
+	l.readMux.Lock()
+	defer l.readMux.Unlock()
+	if l.detached.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := l.Conn.Read(b)
+	if err != nil && l.detached.Load() {
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+func (l *upstreamLease) Write(b []byte) (int, error) {
+	if l.detached.Load() {
+		return 0, net.ErrClosed
+	}
+	return l.Conn.Write(b)
+}
+
+// SetReadDeadline is synchronized with detach, so detached lease can't
+// extend deadline of read which is going to be interrupted.
+func (l *upstreamLease) SetReadDeadline(t time.Time) error {
+	l.readMux.Lock()
+	defer l.readMux.Unlock()
+	if l.detached.Load() {
+		return nil
+	}
+	return l.Conn.SetReadDeadline(t)
+}
+
+func (l *upstreamLease) SetDeadline(t time.Time) error {
+	return l.SetReadDeadline(t)
+}
+
+func (l *upstreamLease) Close() error {
+	l.once.Do(func() {
+		l.table.release(l)
+	})
+	return nil
+}
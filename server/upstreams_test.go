@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTable(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	addr := upstream.LocalAddr().String()
+	dial := func() (net.Conn, error) {
+		return net.Dial("udp", addr)
+	}
+
+	table := newUpstreamTable(100 * time.Millisecond)
+	defer table.close()
+	first, reused, err := table.acquire("alice", addr, dial)
+	if err != nil || reused {
+		t.Fatalf("unexpected acquire result: reused=%v, err=%v", reused, err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := first.Read(make([]byte, 16))
+		readErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	second, reused, err := table.acquire("alice", addr, dial)
+	if err != nil || !reused {
+		t.Fatalf("socket is not reused: reused=%v, err=%v", reused, err)
+	}
+	if second.LocalAddr().String() != first.LocalAddr().String() {
+		t.Error("reused lease has different local address")
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("unexpected read error of detached lease: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read of detached lease is not interrupted")
+	}
+	if _, err := first.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("detached lease is writable: %v", err)
+	}
+	// closing detached lease doesn't park socket of new owner
+	first.Close()
+	if _, err := second.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, 16)
+	_, from, err := upstream.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.WriteTo([]byte("pong"), from)
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := second.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("unexpected read: %q, %v", buf[:n], err)
+	}
+
+	other, reused, err := table.acquire("bob", addr, dial)
+	if err != nil || reused {
+		t.Fatalf("socket of other key is reused: reused=%v, err=%v", reused, err)
+	}
+	other.Close()
+
+	second.Close()
+	third, reused, err := table.acquire("alice", addr, dial)
+	if err != nil || !reused {
+		t.Fatalf("parked socket is not reused: reused=%v, err=%v", reused, err)
+	}
+	third.Close()
+	time.Sleep(200 * time.Millisecond)
+	fourth, reused, err := table.acquire("alice", addr, dial)
+	if err != nil || reused {
+		t.Fatalf("socket is reused after grace period: reused=%v, err=%v", reused, err)
+	}
+	fourth.Close()
+}
@@ -0,0 +1,162 @@
+package session
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SenseUnit/dtlspipe/metrics"
+	"github.com/SenseUnit/dtlspipe/util"
+)
+
+type Info struct {
+	ID                string    `json:"id"`
+	Role              string    `json:"role"`
+	LocalAddr         string    `json:"local_addr"`
+	RemoteAddr        string    `json:"remote_addr"`
+	Identity          string    `json:"identity"`
+	Upstream          string    `json:"upstream"`
+	StartTime         time.Time `json:"start_time"`
+	LastActivity      time.Time `json:"last_activity"`
+	UpstreamBytes     uint64    `json:"upstream_bytes"`
+	UpstreamPackets   uint64    `json:"upstream_packets"`
+	DownstreamBytes   uint64    `json:"downstream_bytes"`
+	DownstreamPackets uint64    `json:"downstream_packets"`
+}
+
+type Session struct {
+	id         string
+	role       string
+	localAddr  string
+	remoteAddr string
+	identity   string
+	upstream   atomic.Pointer[string]
+	startTime  time.Time
+	cancel     context.CancelFunc
+	stats      util.PairStats
+}
+
+func New(role, localAddr, remoteAddr, identity, upstream string, cancel context.CancelFunc) *Session {
+	var idBuf [8]byte
+	if _, err := crand.Read(idBuf[:]); err != nil {
+		panic(fmt.Errorf("crypto/rand.Read failed: %w", err))
+	}
+	now := time.Now()
+	s := &Session{
+		id:         hex.EncodeToString(idBuf[:]),
+		role:       role,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		identity:   identity,
+		startTime:  now,
+		cancel:     cancel,
+		stats: util.PairStats{
+			UpstreamBytes:     new(metrics.Counter),
+			UpstreamPackets:   new(metrics.Counter),
+			DownstreamBytes:   new(metrics.Counter),
+			DownstreamPackets: new(metrics.Counter),
+			LastActivity:      new(metrics.Gauge),
+		},
+	}
+	s.stats.LastActivity.Set(now.UnixNano())
+	s.upstream.Store(&upstream)
+	return s
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Stats returns counters which should be passed to util.PairConn serving
+// this session.
+func (s *Session) Stats() *util.PairStats {
+	return &s.stats
+}
+
+func (s *Session) SetUpstream(upstream string) {
+	s.upstream.Store(&upstream)
+}
+
+func (s *Session) Kill() {
+	s.cancel()
+}
+
+func (s *Session) Info() Info {
+	return Info{
+		ID:                s.id,
+		Role:              s.role,
+		LocalAddr:         s.localAddr,
+		RemoteAddr:        s.remoteAddr,
+		Identity:          s.identity,
+		Upstream:          *s.upstream.Load(),
+		StartTime:         s.startTime,
+		LastActivity:      time.Unix(0, s.stats.LastActivity.Value()),
+		UpstreamBytes:     s.stats.UpstreamBytes.Value(),
+		UpstreamPackets:   s.stats.UpstreamPackets.Value(),
+		DownstreamBytes:   s.stats.DownstreamBytes.Value(),
+		DownstreamPackets: s.stats.DownstreamPackets.Value(),
+	}
+}
+
+type Registry struct {
+	mux      sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (r *Registry) Add(s *Session) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.sessions[s.id] = s
+}
+
+func (r *Registry) Remove(s *Session) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.sessions, s.id)
+}
+
+func (r *Registry) List() []Info {
+	r.mux.Lock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mux.Unlock()
+
+	res := make([]Info, 0, len(sessions))
+	for _, s := range sessions {
+		res = append(res, s.Info())
+	}
+	slices.SortFunc(res, func(a, b Info) int {
+		if c := a.StartTime.Compare(b.StartTime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return res
+}
+
+// Kill terminates session with specified ID. It returns false if no such
+// session found.
+func (r *Registry) Kill(id string) bool {
+	r.mux.Lock()
+	s, ok := r.sessions[id]
+	r.mux.Unlock()
+	if !ok {
+		return false
+	}
+	s.Kill()
+	return true
+}
@@ -0,0 +1,41 @@
+package session
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := New("server", "127.0.0.1:1", "127.0.0.1:2", "alice", "127.0.0.1:3", cancel)
+	r.Add(s)
+
+	s.Stats().UpstreamBytes.Add(10)
+	s.Stats().DownstreamPackets.Inc()
+
+	list := r.List()
+	if len(list) != 1 {
+		t.Fatalf("unexpected sessions count: %d", len(list))
+	}
+	info := list[0]
+	if info.ID != s.ID() || info.Identity != "alice" || info.UpstreamBytes != 10 || info.DownstreamPackets != 1 {
+		t.Errorf("unexpected session info: %#v", info)
+	}
+
+	if r.Kill("nonexistent") {
+		t.Errorf("kill of nonexistent session succeeded")
+	}
+	if !r.Kill(s.ID()) {
+		t.Errorf("kill failed")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("session context was not cancelled")
+	}
+
+	r.Remove(s)
+	if len(r.List()) != 0 {
+		t.Errorf("session was not removed")
+	}
+}
@@ -0,0 +1,113 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadCertificate reads PEM-encoded certificate chain and private key.
+func LoadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can't load certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// LoadCertPool reads PEM-encoded CA certificates from file.
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates found in CA file %q", filename)
+	}
+	return pool, nil
+}
+
+// SPKIHash returns SHA-256 hash of certificate's SubjectPublicKeyInfo.
+func SPKIHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// ParseSPKIPins parses comma-separated list of base64-encoded SHA-256
+// hashes of SubjectPublicKeyInfo, the same as pin-sha256 in HPKP.
+func ParseSPKIPins(s string) ([][]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var pins [][]byte
+	for _, part := range strings.Split(s, ",") {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("can't decode pin %q: %w", part, err)
+		}
+		if len(pin) != sha256.Size {
+			return nil, fmt.Errorf("pin %q has wrong length %d", part, len(pin))
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// VerifySPKIPins returns peer certificate verification function which
+// accepts peer only if hash of its leaf certificate public key is one of
+// pins.
+func VerifySPKIPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	allowed := make(map[string]struct{}, len(pins))
+	for _, pin := range pins {
+		allowed[string(pin)] = struct{}{}
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no peer certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("can't parse peer certificate: %w", err)
+		}
+		if _, ok := allowed[string(SPKIHash(cert))]; !ok {
+			return errors.New("peer public key doesn't match any pin")
+		}
+		return nil
+	}
+}
+
+// VerifyClientCert returns peer certificate verification function which
+// checks client certificate chain against roots.
+func VerifyClientCert(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no client certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("can't parse client certificate: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return fmt.Errorf("client certificate verification failed: %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, cn string, usage x509.ExtKeyUsage, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestParseSPKIPins(t *testing.T) {
+	pins, err := ParseSPKIPins("aiTbZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY=, AAAAZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY=")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pins) != 2 {
+		t.Errorf("unexpected number of pins: %d", len(pins))
+	}
+	for _, input := range []string{
+		"not base64",
+		"AAAA",
+		"aiTbZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY=,",
+	} {
+		if _, err := ParseSPKIPins(input); err == nil {
+			t.Errorf("input %q: expected error", input)
+		}
+	}
+}
+
+func TestVerifySPKIPins(t *testing.T) {
+	ca, _ := testCert(t, "ca", x509.ExtKeyUsageServerAuth, nil, nil)
+	other, _ := testCert(t, "other", x509.ExtKeyUsageServerAuth, nil, nil)
+	pins, err := ParseSPKIPins(base64.StdEncoding.EncodeToString(SPKIHash(ca)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := VerifySPKIPins(pins)
+	if err := verify([][]byte{ca.Raw}, nil); err != nil {
+		t.Errorf("pinned certificate rejected: %v", err)
+	}
+	if err := verify([][]byte{other.Raw}, nil); err == nil {
+		t.Error("certificate with other key accepted")
+	}
+	if err := verify(nil, nil); err == nil {
+		t.Error("empty chain accepted")
+	}
+}
+
+func TestVerifyClientCert(t *testing.T) {
+	ca, caKey := testCert(t, "ca", x509.ExtKeyUsageAny, nil, nil)
+	otherCA, otherKey := testCert(t, "other", x509.ExtKeyUsageAny, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	verify := VerifyClientCert(roots)
+
+	alice, _ := testCert(t, "alice", x509.ExtKeyUsageClientAuth, ca, caKey)
+	if err := verify([][]byte{alice.Raw}, nil); err != nil {
+		t.Errorf("valid client certificate rejected: %v", err)
+	}
+	server, _ := testCert(t, "server", x509.ExtKeyUsageServerAuth, ca, caKey)
+	if err := verify([][]byte{server.Raw}, nil); err == nil {
+		t.Error("certificate without client auth usage accepted")
+	}
+	mallory, _ := testCert(t, "mallory", x509.ExtKeyUsageClientAuth, otherCA, otherKey)
+	if err := verify([][]byte{mallory.Raw}, nil); err == nil {
+		t.Error("certificate issued by unknown CA accepted")
+	}
+}
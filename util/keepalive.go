@@ -0,0 +1,43 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+)
+
+// KeepaliveProtocol is ALPN protocol name of connections with keepalives
+// without other protocol features. Server discards keepalives only on
+// connections which negotiated them.
+const KeepaliveProtocol = "dtlspipe-ka/1"
+
+const keepaliveProtocolSuffix = "+ka"
+
+// KeepaliveDatagram is sent by client inside DTLS connection to keep NAT
+// bindings alive. Server discards it instead of forwarding to upstream.
+var KeepaliveDatagram = []byte("\x00dtlspipe/ka")
+
+// IsKeepalive reports whether datagram b is a keepalive.
+func IsKeepalive(b []byte) bool {
+	return bytes.Equal(b, KeepaliveDatagram)
+}
+
+// KeepaliveProtocolFor returns ALPN protocol name of variant of protocol
+// with keepalives.
+func KeepaliveProtocolFor(protocol string) string {
+	if protocol == "" {
+		return KeepaliveProtocol
+	}
+	return protocol + keepaliveProtocolSuffix
+}
+
+// SplitKeepaliveProtocol returns protocol without keepalives and reports
+// whether protocol is variant with keepalives.
+func SplitKeepaliveProtocol(protocol string) (string, bool) {
+	if protocol == KeepaliveProtocol {
+		return "", true
+	}
+	if base, ok := strings.CutSuffix(protocol, keepaliveProtocolSuffix); ok {
+		return base, true
+	}
+	return protocol, false
+}
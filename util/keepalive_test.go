@@ -0,0 +1,15 @@
+package util
+
+import "testing"
+
+func TestKeepaliveProtocol(t *testing.T) {
+	if base, ok := SplitKeepaliveProtocol(KeepaliveProtocolFor("")); base != "" || !ok {
+		t.Errorf("unexpected split: %q, %v", base, ok)
+	}
+	if base, ok := SplitKeepaliveProtocol(KeepaliveProtocolFor("dtlspipe-mux/1")); base != "dtlspipe-mux/1" || !ok {
+		t.Errorf("unexpected split: %q, %v", base, ok)
+	}
+	if base, ok := SplitKeepaliveProtocol("dtlspipe-mux/1"); base != "dtlspipe-mux/1" || ok {
+		t.Errorf("unexpected split: %q, %v", base, ok)
+	}
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+)
+
+// Log attribute keys shared by client and server records.
+const (
+	LogKeySession    = "session"
+	LogKeyLocalAddr  = "local_addr"
+	LogKeyRemoteAddr = "remote_addr"
+	LogKeyIdentity   = "identity"
+	LogKeyEndpoint   = "endpoint"
+	LogKeyFlow       = "flow"
+	LogKeyError      = "error"
+	LogKeyErrorClass = "error_class"
+)
+
+// ErrorClass classifies error for logs. It extends HandshakeFailureReason
+// with "closed" class for operations on closed connections.
+func ErrorClass(err error) string {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+		return "closed"
+	}
+	return HandshakeFailureReason(err)
+}
+
+// ErrorAttrs returns log attributes describing err.
+func ErrorAttrs(err error) []any {
+	return []any{
+		slog.Any(LogKeyError, err),
+		slog.String(LogKeyErrorClass, ErrorClass(err)),
+	}
+}
+
+// ConnLogger returns logger annotated with addresses of conn.
+func ConnLogger(logger *slog.Logger, conn net.Conn) *slog.Logger {
+	return logger.With(
+		slog.String(LogKeyLocalAddr, conn.LocalAddr().String()),
+		slog.String(LogKeyRemoteAddr, conn.RemoteAddr().String()),
+	)
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	MaxPSKLength = 64
+
+	maxSecretLength = 1024
+)
+
+// DecodePSKHex decodes hex-encoded PSK ignoring surrounding whitespace
+// and checks its length.
+func DecodePSKHex(src []byte) ([]byte, error) {
+	src = bytes.TrimSpace(src)
+	switch {
+	case len(src) == 0:
+		return nil, errors.New("empty PSK")
+	case hex.DecodedLen(len(src)) > MaxPSKLength:
+		return nil, fmt.Errorf("PSK is longer than %d bytes", MaxPSKLength)
+	}
+	psk := make([]byte, hex.DecodedLen(len(src)))
+	if _, err := hex.Decode(psk, src); err != nil {
+		clear(psk)
+		return nil, fmt.Errorf("can't hex-decode PSK: %w", err)
+	}
+	return psk, nil
+}
+
+// ReadSecret reads the first line of r with surrounding whitespace
+// removed. Read buffer is zeroed before return, caller should zero
+// returned secret after use.
+func ReadSecret(r io.Reader) ([]byte, error) {
+	buf := make([]byte, maxSecretLength)
+	defer clear(buf)
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if idx := bytes.IndexByte(buf[:n], '\n'); idx >= 0 {
+			return bytes.Clone(bytes.TrimSpace(buf[:idx])), nil
+		}
+		if errors.Is(err, io.EOF) {
+			return bytes.Clone(bytes.TrimSpace(buf[:n])), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("secret read failed: %w", err)
+		}
+	}
+	return nil, errors.New("secret input is too long")
+}
+
+// ReadSecretFile reads the first line of file with surrounding
+// whitespace removed.
+func ReadSecretFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't open secret file: %w", err)
+	}
+	defer f.Close()
+	secret, err := ReadSecret(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't read secret file %q: %w", filename, err)
+	}
+	return secret, nil
+}
+
+// ReadPSKHex reads hex-encoded PSK from the first line of r.
+func ReadPSKHex(r io.Reader) ([]byte, error) {
+	secret, err := ReadSecret(r)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(secret)
+	return DecodePSKHex(secret)
+}
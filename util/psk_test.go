@@ -0,0 +1,29 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadPSKHex(t *testing.T) {
+	psk, err := ReadPSKHex(strings.NewReader("  00112233aabbccdd \n# ignored\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(psk, []byte{0x00, 0x11, 0x22, 0x33, 0xaa, 0xbb, 0xcc, 0xdd}) {
+		t.Errorf("unexpected PSK: %x", psk)
+	}
+	for _, input := range []string{
+		"",
+		" \n",
+		"xyz",
+		"abc",
+		strings.Repeat("aa", MaxPSKLength+1),
+		strings.Repeat("a", maxSecretLength),
+	} {
+		if _, err := ReadPSKHex(strings.NewReader(input)); err == nil {
+			t.Errorf("input %q: expected error", input)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package util
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// GenerateKey generates private key of given type: "ed25519" or "ecdsa"
+// (P-256).
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %q", keyType)
+}
+
+// MarshalPrivateKeyPEM encodes private key as PEM-encoded PKCS #8.
+func MarshalPrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// LoadPrivateKey reads PEM-encoded private key in PKCS #8, SEC 1 or
+// PKCS #1 form from file.
+func LoadPrivateKey(filename string) (crypto.Signer, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key file: %w", err)
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("no private key found in file %q", filename)
+		}
+		if key, err := parsePrivateKeyBlock(block); key != nil || err != nil {
+			return key, err
+		}
+	}
+}
+
+// LoadPublicKey reads public key from PEM-encoded certificate, public key
+// or private key file.
+func LoadPublicKey(filename string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key file: %w", err)
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("no key or certificate found in file %q", filename)
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse certificate: %w", err)
+			}
+			return cert.PublicKey, nil
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		}
+		key, err := parsePrivateKeyBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return key.Public(), nil
+		}
+	}
+}
+
+// parsePrivateKeyBlock returns nil key and nil error if block doesn't
+// hold private key.
+func parsePrivateKeyBlock(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse private key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		return signer, nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse private key: %w", err)
+		}
+		return key, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse private key: %w", err)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// SelfSignedCertificate wraps key into self-signed certificate with
+// given common name. Such certificates are meant to be verified by
+// public key fingerprint.
+func SelfSignedCertificate(key crypto.Signer, commonName string) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can't generate serial number: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-24 * time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("can't create certificate: %w", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// KeyFingerprint returns base64-encoded SHA-256 hash of public key
+// SubjectPublicKeyInfo, the same as used by -pin-sha256 option.
+func KeyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("can't marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+func LoadPeerKeysFile(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't open peer keys file: %w", err)
+	}
+	defer f.Close()
+	keys, err := ParsePeerKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't load peer keys file %q: %w", filename, err)
+	}
+	return keys, nil
+}
+
+// ParsePeerKeys reads allowed peer public key fingerprints. Each
+// non-empty line holds fingerprint optionally followed by peer identity
+// separated by whitespace. Lines starting with '#' are ignored. Returned
+// map is keyed by raw SPKI hash.
+func ParsePeerKeys(r io.Reader) (map[string]string, error) {
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected fingerprint and optional identity, got %d fields", lineNum, len(fields))
+		}
+		pins, err := ParseSPKIPins(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if _, ok := keys[string(pins[0])]; ok {
+			return nil, fmt.Errorf("line %d: duplicate fingerprint %q", lineNum, fields[0])
+		}
+		identity := ""
+		if len(fields) == 2 {
+			identity = fields[1]
+		}
+		keys[string(pins[0])] = identity
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("peer keys read failed: %w", err)
+	}
+	return keys, nil
+}
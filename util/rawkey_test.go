@@ -0,0 +1,84 @@
+package util
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	for _, keyType := range []string{"ed25519", "ecdsa"} {
+		key, err := GenerateKey(keyType)
+		if err != nil {
+			t.Fatalf("%s: key generation failed: %v", keyType, err)
+		}
+		keyPEM, err := MarshalPrivateKeyPEM(key)
+		if err != nil {
+			t.Fatalf("%s: marshal failed: %v", keyType, err)
+		}
+		keyFile := filepath.Join(t.TempDir(), "key.pem")
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadPrivateKey(keyFile)
+		if err != nil {
+			t.Fatalf("%s: load failed: %v", keyType, err)
+		}
+
+		cert, err := SelfSignedCertificate(loaded, "alice")
+		if err != nil {
+			t.Fatalf("%s: certificate creation failed: %v", keyType, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName != "alice" {
+			t.Errorf("%s: unexpected common name %q", keyType, leaf.Subject.CommonName)
+		}
+		fingerprint, err := KeyFingerprint(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fingerprint != base64.StdEncoding.EncodeToString(SPKIHash(leaf)) {
+			t.Errorf("%s: fingerprint doesn't match certificate public key", keyType)
+		}
+		pub, err := LoadPublicKey(keyFile)
+		if err != nil {
+			t.Fatalf("%s: public key load failed: %v", keyType, err)
+		}
+		if fp, _ := KeyFingerprint(pub); fp != fingerprint {
+			t.Errorf("%s: fingerprint of loaded public key mismatch", keyType)
+		}
+	}
+}
+
+func TestParsePeerKeys(t *testing.T) {
+	keys, err := ParsePeerKeys(strings.NewReader(`
+# comment
+aiTbZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY= phone
+  clxYb4tbi0DLrRQinontL0FgvLLq84aiU9CCRVU0xqY=
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("unexpected number of keys: %d", len(keys))
+	}
+	pins, _ := ParseSPKIPins("aiTbZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY=")
+	if identity, ok := keys[string(pins[0])]; !ok || identity != "phone" {
+		t.Errorf("unexpected identity %q", identity)
+	}
+	for _, input := range []string{
+		"AAAA",
+		"aiTbZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY= phone extra",
+		"aiTbZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY=\naiTbZLPh3ZMMDcoH8KmGi1Kz3VC88d1VjrR9xyDrRBY= phone",
+	} {
+		if _, err := ParsePeerKeys(strings.NewReader(input)); err == nil {
+			t.Errorf("input %q: expected error", input)
+		}
+	}
+}
@@ -4,14 +4,16 @@ import (
 	"context"
 	crand "crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/netip"
 	"sync"
 	"time"
 
+	"github.com/SenseUnit/dtlspipe/metrics"
 	"github.com/Snawoot/rlzone"
 )
 
@@ -56,11 +58,62 @@ func isTemporary(err error) bool {
 	return false
 }
 
+// HandshakeFailureReason classifies DTLS handshake error for metrics.
+func HandshakeFailureReason(err error) string {
+	var alertErr interface {
+		IsFatalOrCloseNotify() bool
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &alertErr):
+		return "alert"
+	}
+	return "error"
+}
+
 const (
 	MaxPktBuf = 65536
 )
 
-func PairConn(ctx context.Context, left, right net.Conn, idleTimeout time.Duration, staleMode StaleMode) {
+// PairStats holds counters updated by PairConn. Upstream direction is
+// from left connection to right one. LastActivity is set to UnixNano
+// timestamp of last forwarded datagram. Any field may be nil.
+type PairStats struct {
+	UpstreamBytes     *metrics.Counter
+	UpstreamPackets   *metrics.Counter
+	DownstreamBytes   *metrics.Counter
+	DownstreamPackets *metrics.Counter
+	StaleDrops        *metrics.Counter
+	LastActivity      *metrics.Gauge
+}
+
+func (s *PairStats) update(upstream bool, n int) {
+	if upstream {
+		s.UpstreamBytes.Add(uint64(n))
+		s.UpstreamPackets.Inc()
+	} else {
+		s.DownstreamBytes.Add(uint64(n))
+		s.DownstreamPackets.Inc()
+	}
+	if s.LastActivity != nil {
+		s.LastActivity.Set(time.Now().UnixNano())
+	}
+}
+
+func NewPairStats(role string, staleMode StaleMode) *PairStats {
+	return &PairStats{
+		UpstreamBytes:     metrics.Bytes.With(role, "upstream"),
+		UpstreamPackets:   metrics.Packets.With(role, "upstream"),
+		DownstreamBytes:   metrics.Bytes.With(role, "downstream"),
+		DownstreamPackets: metrics.Packets.With(role, "downstream"),
+		StaleDrops:        metrics.StaleDrops.With(role, staleMode.String()),
+	}
+}
+
+func PairConn(ctx context.Context, logger *slog.Logger, left, right net.Conn, idleTimeout time.Duration, staleMode StaleMode, stats ...*PairStats) {
 	var wg sync.WaitGroup
 	tracker := newTracker(staleMode)
 
@@ -81,7 +134,7 @@ func PairConn(ctx context.Context, left, right net.Conn, idleTimeout time.Durati
 		buf := make([]byte, MaxPktBuf)
 		for {
 			if err := src.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
-				log.Printf("can't update deadline for connection: %v", err)
+				logger.Warn("can't update deadline for connection", ErrorAttrs(err)...)
 				break
 			}
 
@@ -93,24 +146,30 @@ func PairConn(ctx context.Context, left, right net.Conn, idleTimeout time.Durati
 						// not stale conn
 						continue
 					} else {
-						log.Printf("dropping stale connection %s <=> %s", src.LocalAddr(), src.RemoteAddr())
+						for _, st := range stats {
+							st.StaleDrops.Inc()
+						}
+						logger.Info("dropping stale connection", slog.String("peer", src.RemoteAddr().String()))
 					}
 				} else {
 					// any other error
 					if isTemporary(err) {
-						log.Printf("ignoring temporary error during read from %s: %v", src.RemoteAddr(), err)
+						logger.Debug("ignoring temporary read error", pairErrorAttrs(src, err)...)
 						continue
 					}
-					log.Printf("read from %s error: %v", src.RemoteAddr(), err)
+					logger.Log(ctx, pairErrorLevel(err), "read error", pairErrorAttrs(src, err)...)
 				}
 				break
 			}
 
 			tracker.notify(label)
+			for _, st := range stats {
+				st.update(label, n)
+			}
 
 			_, err = dst.Write(buf[:n])
 			if err != nil {
-				log.Printf("write to %s error: %v", dst.RemoteAddr(), err)
+				logger.Log(ctx, pairErrorLevel(err), "write error", pairErrorAttrs(dst, err)...)
 				break
 			}
 		}
@@ -122,6 +181,20 @@ func PairConn(ctx context.Context, left, right net.Conn, idleTimeout time.Durati
 	wg.Wait()
 }
 
+func pairErrorAttrs(conn net.Conn, err error) []any {
+	return append([]any{slog.String("peer", conn.RemoteAddr().String())}, ErrorAttrs(err)...)
+}
+
+// pairErrorLevel returns level for errors of PairConn. Errors caused by
+// session teardown are logged at debug level.
+func pairErrorLevel(err error) slog.Level {
+	switch ErrorClass(err) {
+	case "closed", "canceled":
+		return slog.LevelDebug
+	}
+	return slog.LevelWarn
+}
+
 func NetAddrToNetipAddrPort(a net.Addr) netip.AddrPort {
 	switch v := a.(type) {
 	case *net.UDPAddr:
@@ -186,21 +259,26 @@ func NewDynDialer(ep func() string) DynDialer {
 func (d DynDialer) DialContext(ctx context.Context) (net.PacketConn, net.Addr, error) {
 	host, port, err := net.SplitHostPort(d.ep())
 	if err != nil {
+		metrics.DialFailures.With("client", "endpoint").Inc()
 		return nil, nil, fmt.Errorf("unable to split host and port: %w", err)
 	}
 	addrs, err := d.resolver.LookupIPAddr(ctx, host)
 	if err != nil {
+		metrics.DialFailures.With("client", "resolve").Inc()
 		return nil, nil, fmt.Errorf("address lookup failed: %w", err)
 	}
 	if len(addrs) == 0 {
+		metrics.DialFailures.With("client", "resolve").Inc()
 		return nil, nil, fmt.Errorf("no addresses were resolved")
 	}
 	portNum, err := d.resolver.LookupPort(ctx, "udp", port)
 	if err != nil {
+		metrics.DialFailures.With("client", "resolve").Inc()
 		return nil, nil, fmt.Errorf("port lookup failed: %w", err)
 	}
 	pConn, err := net.ListenUDP("udp", nil)
 	if err != nil {
+		metrics.DialFailures.With("client", "socket").Inc()
 		return nil, nil, fmt.Errorf("unable to open UDP socket: %w", err)
 	}
 	return pConn, &net.UDPAddr{